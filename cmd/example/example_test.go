@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/quells/munin/pkg/munin/munintest"
+)
+
+func TestConfig(t *testing.T) {
+	munintest.Golden(t, "config", munintest.Config(t, new(myPlugin), nil))
+}
+
+func TestFieldsMatch(t *testing.T) {
+	munintest.FieldsMatch(t, new(myPlugin), nil)
+}
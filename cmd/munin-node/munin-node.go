@@ -0,0 +1,103 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command munin-node serves munin plugin executables over the munin-node protocol.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/node"
+	"github.com/quells/munin/pkg/pluginconf"
+)
+
+// envFlags collects repeated -env key=value flags.
+type envFlags munin.Env
+
+func (e envFlags) String() string {
+	pairs := make([]string, 0, len(e))
+	for k, v := range e {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (e envFlags) Set(text string) error {
+	parts := strings.SplitN(text, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected key=value, got %q", text)
+	}
+	e[parts[0]] = parts[1]
+	return nil
+}
+
+func main() {
+	env := make(envFlags)
+
+	s := new(node.Server)
+	listen := flag.String("listen", fmt.Sprintf(":%d", node.DefaultPort), "address to listen on")
+	flag.StringVar(&s.PluginDir, "plugins", "/etc/munin/plugins", "directory of plugin executables")
+	flag.StringVar(&s.Hostname, "hostname", "", "hostname reported to the master (default OS hostname)")
+	flag.DurationVar(&s.Timeout, "timeout", 10*time.Second, "timeout for each plugin run")
+	flag.DurationVar(&s.IdleTimeout, "idle-timeout", 20*time.Second, "close connections from masters idle for this long")
+	flag.Var(env, "env", "key=value passed to every plugin, may be repeated")
+	conf := flag.String("conf", pluginconf.DefaultDir, "plugin-conf.d style file or directory")
+	allow := flag.String("allow", "", "comma separated networks masters may connect from, e.g. 192.168.1.0/24 (default everywhere)")
+	flag.Parse()
+
+	var err error
+	if s.Allow, err = node.ParseAllow(*allow); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := os.Stat(*conf); err == nil {
+		if s.Conf, err = pluginconf.Read(*conf); err != nil {
+			log.Fatal(err)
+		}
+	} else if *conf != pluginconf.DefaultDir {
+		log.Fatal(err)
+	}
+
+	s.Env = munin.Env(env)
+	if _, ok := s.Env["MUNIN_PLUGSTATE"]; !ok {
+		s.Env["MUNIN_PLUGSTATE"] = munin.DefaultStateDir
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	log.Printf("listening on %s", *listen)
+	if err := s.ListenAndServe(*listen); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Command munin-run runs a plugin the way munin-node would and pretty-prints the result.
+//
+// The plugin is configured from plugin-conf.d style files and run with the same environment
+// munin-node gives it. The plugin may be an executable, either a path or a name in the
+// plugins directory, or a directory containing a Go plugin's main package, which is built first.
+// Go plugins can also be run in-process with the muninrun package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/quells/munin/pkg/muninrun"
+	"github.com/quells/munin/pkg/pluginconf"
+)
+
+func main() {
+	var r muninrun.Runner
+	conf := flag.String("conf", pluginconf.DefaultDir, "plugin-conf.d style file or directory")
+	flag.StringVar(&r.PluginDir, "plugins", "/etc/munin/plugins", "directory of plugin executables")
+	flag.StringVar(&r.Name, "name", "", "name to run the plugin as (default the base name of the plugin)")
+	flag.BoolVar(&r.Multigraph, "multigraph", true, "advertise the multigraph capability")
+	flag.BoolVar(&r.DirtyConfig, "dirtyconfig", false, "advertise the dirtyconfig capability")
+	flag.BoolVar(&r.Raw, "raw", false, "print plugin output as-is")
+	flag.BoolVar(&r.Verbose, "v", false, "print the environment set for the plugin")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: munin-run [flags] plugin [command]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Without a command, runs config and fetch and prints both with validation problems.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := os.Stat(*conf); err == nil {
+		if r.Conf, err = pluginconf.Read(*conf); err != nil {
+			fail(err)
+		}
+	} else if *conf != pluginconf.DefaultDir {
+		fail(err)
+	}
+
+	if err := r.Run(flag.Arg(0), flag.Arg(1)); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "munin-run: %v\n", err)
+	os.Exit(1)
+}
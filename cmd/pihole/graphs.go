@@ -0,0 +1,198 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+// queryTyper is a client which can break queries down by type.
+type queryTyper interface {
+	QueryTypes(ctx context.Context) (types map[string]float64, err error)
+}
+
+const queryTypesInfo = "This graph shows the percentage of DNS queries of each type submitted to this Pi-Hole over a rolling 24-hour period (at the time of retrieval)."
+
+func (p *piHole) Graphs(env munin.Env) (confs map[string]munin.Config, err error) {
+	return p.GraphsContext(context.Background(), env)
+}
+
+// GraphsContext returns the summary graph from ConfigContext, with the query type
+// and upstream breakdowns nested under it once a fetch has seen them.
+// Configuration comes from the environment and plugin state alone, so it works without the Pi-Hole
+// and does not slow down every fetch, which Run also configures to report missing values.
+func (p *piHole) GraphsContext(ctx context.Context, env munin.Env) (confs map[string]munin.Config, err error) {
+	conf, err := p.ConfigContext(ctx, env)
+	if err != nil {
+		return
+	}
+	root := rootGraph(env)
+	confs = map[string]munin.Config{root: conf}
+
+	if types := savedQueryTypes(env); len(types) != 0 {
+		confs[root+".query_types"] = queryTypesConfig(env, types)
+	}
+	if seen := savedUpstreams(env); len(seen) != 0 {
+		confs[root+".upstreams"] = upstreamsConfig(env, seen)
+	}
+	return
+}
+
+func (p *piHole) FetchGraphs(env munin.Env) (values map[string]munin.Values, precision map[string]munin.Precision, err error) {
+	return p.FetchGraphsContext(context.Background(), env)
+}
+
+func (p *piHole) FetchGraphsContext(ctx context.Context, env munin.Env) (values map[string]munin.Values, precision map[string]munin.Precision, err error) {
+	if hostOf(env) == "" {
+		err = errNoHost
+		return
+	}
+
+	client, err := clientFor(ctx, env)
+	if err != nil {
+		return
+	}
+
+	root := rootGraph(env)
+	values = make(map[string]munin.Values)
+	precision = make(map[string]munin.Precision)
+
+	values[root], precision[root], err = client.LoadContext(ctx)
+	var partial *munin.PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return
+	}
+
+	// the other graphs are still worth reporting if one of the breakdowns fails
+	var failed []string
+
+	types, ok, typesErr := queryTypes(ctx, env, client)
+	if typesErr != nil {
+		failed = append(failed, fmt.Sprintf("query types: %v", typesErr))
+	} else if ok {
+		graph := root + ".query_types"
+		values[graph] = make(munin.Values, len(types))
+		for name, percent := range types {
+			values[graph][munin.CleanFieldName(name)] = percent
+		}
+		precision[graph] = percentPrecision(values[graph])
+	}
+
+	upstreamValues, ok, upstreamsErr := upstreams(ctx, env, client)
+	if upstreamsErr != nil {
+		failed = append(failed, fmt.Sprintf("upstreams: %v", upstreamsErr))
+	} else if ok {
+		graph := root + ".upstreams"
+		values[graph] = upstreamValues
+		precision[graph] = percentPrecision(upstreamValues)
+	}
+
+	if len(failed) != 0 {
+		if err != nil {
+			failed = append([]string{err.Error()}, failed...)
+		}
+		err = &munin.PartialError{Err: errors.New(strings.Join(failed, "; "))}
+	}
+	return
+}
+
+// percentPrecision of two decimal places for each value.
+func percentPrecision(values munin.Values) munin.Precision {
+	precision := make(munin.Precision, len(values))
+	for key := range values {
+		precision[key] = 2
+	}
+	return precision
+}
+
+// rootGraph name for the plugin, without the dots of a wildcard suffix like pihole_pi.hole
+// which would nest it under another graph.
+func rootGraph(env munin.Env) string {
+	name := env.Plugin()
+	if name == "" {
+		name = "pihole"
+	}
+	return munin.CleanFieldName(name)
+}
+
+// queryTypesKey in plugin state for the names of the query types last fetched.
+const queryTypesKey = "query-types"
+
+// queryTypes from the client, or false if it cannot break queries down by type,
+// like the v5 API without a token. The names are saved for queryTypesConfig,
+// and cleared if the client can no longer break queries down.
+func queryTypes(ctx context.Context, env munin.Env, client statsClient) (types map[string]float64, ok bool, err error) {
+	if qt, isTyper := client.(queryTyper); isTyper {
+		types, err = qt.QueryTypes(ctx)
+		var confErr *munin.ConfigError
+		if errors.As(err, &confErr) {
+			types, err = nil, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err = env.State().Save(queryTypesKey, names); err != nil {
+		return nil, false, fmt.Errorf("saving query types: %w", err)
+	}
+	return types, types != nil, nil
+}
+
+// savedQueryTypes from the last fetch, or none if it could not break queries down by type.
+func savedQueryTypes(env munin.Env) (names []string) {
+	if _, err := env.State().Load(queryTypesKey, &names); err != nil {
+		return nil
+	}
+	return
+}
+
+// queryTypesConfig with a stacked series for each type, keyed by its cleaned name.
+func queryTypesConfig(env munin.Env, names []string) munin.Config {
+	conf := munin.Config{
+		Title:    "PiHole query types - " + hostOf(env),
+		Category: "dns",
+		Info:     queryTypesInfo,
+		YAxis:    "%",
+		Series:   make(map[string]munin.Series, len(names)),
+	}.WithLimits(0, 100)
+	conf.Rigid = true
+
+	order := make([]string, len(names))
+	for i, name := range names {
+		order[i] = munin.CleanFieldName(name)
+		conf.Series[order[i]] = munin.NewSeries(name).
+			WithType(munin.Gauge).
+			WithDraw(munin.AreaStack).
+			WithRange(0, 100)
+	}
+	return conf.WithOrder(order...)
+}
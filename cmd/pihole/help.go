@@ -57,6 +57,28 @@ var infos = map[string]string{
 const help = `Pi-Hole stats Munin plugin.
 
 Must set env.host in configuration for Pi-Hole web admin interface, including scheme e.g. http://pi.hole
+Running with "autoconf" checks that env.host responds to API requests.
+
+Both the Pi-Hole v5 API and the v6 REST API are supported, detected from env.host unless env.api is set to 5 or 6.
+The detected version is remembered in the plugin state directory for a day.
+For v5, set env.token to the API token if the Pi-Hole requires one, or env.token_file to a file containing it.
+For v6, set env.password to an app password, or the web interface password. Sessions are reused between runs.
+
+When munin-node supports multigraph plugins, graphs of the percentage of queries of each type
+(A, AAAA, PTR, HTTPS, etc.) and answered by each upstream resolver are nested under the summary graph.
+On v5 these require env.token. Query types and upstreams are remembered in the plugin state directory
+by fetch, and config only reads them, so these graphs appear after the first fetch. An upstream which
+goes away is reported as unknown for 30 days instead of disappearing from the graph. Both are forgotten
+when the Pi-Hole can no longer break queries down, e.g. after env.token is removed.
+
+May be linked as a wildcard plugin, e.g. pihole_pi.hole, in which case env.host defaults to http:// followed by the suffix.
+Running with "suggest" lists the suffixes for munin-node-configure to link, trying pi.hole and localhost,
+or the comma separated list of hosts in env.suggest instead.
+
+Can optionally set env.timeout to the number of seconds to wait for the Pi-Hole to respond, 8 by default.
+
+Running with "serve" serves the same values as Prometheus metrics at /metrics instead,
+configured from the environment or a plugin-conf.d file with -conf. See "serve -h" for flags.
 
 Can optionally set env.except to comma separated list of values to skip reporting. Valid entries are:
 - domains_being_blocked
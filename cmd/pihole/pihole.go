@@ -21,26 +21,64 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/quells/munin/internal/pihole5"
+	"github.com/quells/munin/internal/pihole6"
 	"github.com/quells/munin/internal/set"
 	"github.com/quells/munin/pkg/munin"
 )
 
 func main() {
 	p := new(piHole)
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Exit(serve(p, os.Args[2:]))
+	}
 	munin.Run(p)
 }
 
 type piHole struct{}
 
+var errNoHost = &munin.ConfigError{Err: errors.New("env.host is not set")}
+
 func (p *piHole) Help() string {
 	return help
 }
 
+func (p *piHole) AutoConf(env munin.Env) (ok bool, reason string) {
+	host := hostOf(env)
+	if host == "" {
+		return false, "env.host is not set"
+	}
+
+	client, err := clientFor(context.Background(), env)
+	if err != nil {
+		return false, err.Error()
+	}
+	if _, _, err := client.LoadContext(context.Background()); err != nil {
+		return false, err.Error()
+	}
+
+	return true, ""
+}
+
 func (p *piHole) Config(env munin.Env) (conf munin.Config, err error) {
-	conf.Title = "PiHole stats - " + env["host"]
+	return p.ConfigContext(context.Background(), env)
+}
+
+func (p *piHole) ConfigContext(ctx context.Context, env munin.Env) (conf munin.Config, err error) {
+	if hostOf(env) == "" {
+		err = errNoHost
+		return
+	}
+
+	conf.Title = "PiHole stats - " + hostOf(env)
 	conf.Category = "dns"
 	conf.Info = info
 	conf.Series = make(map[string]munin.Series)
@@ -63,11 +101,176 @@ func (p *piHole) Config(env munin.Env) (conf munin.Config, err error) {
 }
 
 func (p *piHole) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
-	client := pihole5.NewClient(env["host"], skipSet(env))
-	values, precision, err = client.Load()
+	return p.FetchContext(context.Background(), env)
+}
+
+func (p *piHole) FetchContext(ctx context.Context, env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	if hostOf(env) == "" {
+		err = errNoHost
+		return
+	}
+
+	client, err := clientFor(ctx, env)
+	if err != nil {
+		return
+	}
+	values, precision, err = client.LoadContext(ctx)
 	return
 }
 
+func (p *piHole) WildcardPrefix() string {
+	return "pihole_"
+}
+
+// suggestHosts are tried by Suggest when env.suggest is not set.
+var suggestHosts = []string{"pi.hole", "localhost"}
+
+// suggestTimeout for each host tried by Suggest, kept short since most will not be a Pi-Hole.
+const suggestTimeout = 2 * time.Second
+
+// Suggest the hosts in env.suggest, or suggestHosts, which respond as a Pi-Hole.
+// One which rejects the credentials still counts, since they can be set once it is linked.
+func (p *piHole) Suggest(env munin.Env) (suggestions []string, err error) {
+	candidates := suggestHosts
+	if env["suggest"] != "" {
+		candidates = nil
+		for _, s := range strings.Split(env["suggest"], ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				candidates = append(candidates, s)
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		if isPiHole(env, c) {
+			suggestions = append(suggestions, c)
+		}
+	}
+	return
+}
+
+// isPiHole reports whether host answers the Pi-Hole API, using the rest of env for credentials.
+func isPiHole(env munin.Env, host string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), suggestTimeout)
+	defer cancel()
+
+	e := make(munin.Env, len(env)+1)
+	for k, v := range env {
+		e[k] = v
+	}
+	e["host"] = "http://" + host
+
+	// detect the API here, since a candidate which is not env.host should not be remembered as its version
+	v6, err := pihole6.Detect(ctx, e["host"])
+	if err != nil {
+		return false
+	}
+	e["api"] = "5"
+	if v6 {
+		e["api"] = "6"
+	}
+
+	client, err := clientFor(ctx, e)
+	if err == nil {
+		_, _, err = client.LoadContext(ctx)
+	}
+	var confErr *munin.ConfigError
+	return err == nil || errors.As(err, &confErr)
+}
+
+// A statsClient loads stats from a Pi-Hole, through either version of its API.
+type statsClient interface {
+	LoadContext(ctx context.Context) (values munin.Values, precision munin.Precision, err error)
+}
+
+// clientFor the Pi-Hole at env.host, speaking the API version in env.api
+// or whichever version the host responds to.
+func clientFor(ctx context.Context, env munin.Env) (client statsClient, err error) {
+	host := hostOf(env)
+
+	var v6 bool
+	switch env["api"] {
+	case "":
+		if v6, err = detect(ctx, env, host); err != nil {
+			return
+		}
+	case "5":
+	case "6":
+		v6 = true
+	default:
+		err = &munin.ConfigError{Err: fmt.Errorf("env.api must be 5 or 6, not %q", env["api"])}
+		return
+	}
+
+	if v6 {
+		return pihole6.NewClient(host, env["password"], skipSet(env), env.State()), nil
+	}
+
+	token, err := tokenOf(env)
+	if err != nil {
+		return
+	}
+	return pihole5.NewClient(host, token, skipSet(env)), nil
+}
+
+// apiVersionKey in plugin state for the API version detected for env.host.
+const apiVersionKey = "api-version"
+
+// redetectAfter this long, in case the Pi-Hole has been upgraded.
+const redetectAfter = 24 * time.Hour
+
+// A detectedVersion of the API, saved so each run does not have to probe for it.
+type detectedVersion struct {
+	Host     string    `json:"host"`
+	V6       bool      `json:"v6"`
+	Detected time.Time `json:"detected"`
+}
+
+// detect whether host speaks the v6 API, remembering the answer in plugin state for redetectAfter.
+// The state is only a cache, so the host is probed if it cannot be read or written.
+func detect(ctx context.Context, env munin.Env, host string) (bool, error) {
+	var saved detectedVersion
+	found, err := env.State().Load(apiVersionKey, &saved)
+	if err == nil && found && saved.Host == host && time.Since(saved.Detected) < redetectAfter {
+		return saved.V6, nil
+	}
+
+	v6, err := pihole6.Detect(ctx, host)
+	if err != nil {
+		return false, err
+	}
+	env.State().Save(apiVersionKey, detectedVersion{Host: host, V6: v6, Detected: time.Now()})
+	return v6, nil
+}
+
+// tokenOf the Pi-Hole v5 API, from env.token or the file at env.token_file,
+// which keeps it out of plugin-conf.d.
+func tokenOf(env munin.Env) (string, error) {
+	if token := env["token"]; token != "" {
+		return token, nil
+	}
+	if file := env["token_file"]; file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", &munin.ConfigError{Err: fmt.Errorf("reading env.token_file: %w", err)}
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// hostOf the Pi-Hole to query, falling back to the wildcard suffix
+// when the plugin is linked as e.g. pihole_pi.hole without an env.host.
+func hostOf(env munin.Env) string {
+	if host := env["host"]; host != "" {
+		return host
+	}
+	if w := env.Wildcard(); w != "" {
+		return "http://" + w
+	}
+	return ""
+}
+
 func skipSet(env munin.Env) set.Strings {
 	except := strings.Split(env["except"], ",")
 	except = append(except, "ads_percentage_today")
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/munin/munintest"
+	"github.com/quells/munin/pkg/prometheus"
+)
+
+const summary = `{
+	"domains_being_blocked": "123,456",
+	"dns_queries_today": "7,890",
+	"ads_blocked_today": "1,234",
+	"ads_percentage_today": "15.6",
+	"unique_domains": "2,345",
+	"queries_forwarded": "3,456",
+	"queries_cached": "2,100",
+	"clients_ever_seen": "12",
+	"unique_clients": "10",
+	"dns_queries_all_types": "7,890",
+	"reply_NODATA": "45",
+	"reply_NXDOMAIN": "67",
+	"reply_CNAME": "1,234",
+	"reply_IP": "4,567",
+	"privacy_level": "0",
+	"status": "enabled"
+}`
+
+const queryTypesResponse = `{"querytypes": {
+	"A (IPv4)": 63.52, "AAAA (IPv6)": 20.1, "ANY": 0, "SRV": 0.2, "SOA": 0, "PTR": 14.18,
+	"TXT": 0, "NAPTR": 0, "MX": 0, "DS": 0, "RRSIG": 0, "DNSKEY": 0, "NS": 0, "OTHER": 0, "SVCB": 0, "HTTPS": 2
+}}`
+
+const forwardDestinationsResponse = `{"forward_destinations": {
+	"blocklist|blocklist": 9.5, "cache|cache": 20.1, "dns.google#53|8.8.8.8#53": 40.2, "one.one.one.one#53|1.1.1.1#53": 30.2
+}}`
+
+// authenticated responses, which need the API token "t0ken".
+var authenticated = map[string]string{
+	"getQueryTypes":          queryTypesResponse,
+	"getForwardDestinations": forwardDestinationsResponse,
+}
+
+func fakePiHole(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/api.php" {
+			http.NotFound(w, r)
+			return
+		}
+		for query, resp := range authenticated {
+			if _, ok := r.URL.Query()[query]; ok {
+				if r.URL.Query().Get("auth") != "t0ken" {
+					w.Write([]byte("[]"))
+					return
+				}
+				w.Write([]byte(resp))
+				return
+			}
+		}
+		w.Write([]byte(summary))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fakePiHole6 speaks the v6 REST API with the same stats as fakePiHole, with the password "secret".
+func fakePiHole6(t *testing.T) *httptest.Server {
+	responses := map[string]string{
+		"/api/stats/summary": `{
+			"queries": {
+				"total": 7890, "blocked": 1234, "unique_domains": 2345, "forwarded": 3456, "cached": 2100,
+				"replies": {"NODATA": 45, "NXDOMAIN": 67, "CNAME": 1234, "IP": 4567}
+			},
+			"clients": {"active": 10, "total": 12},
+			"gravity": {"domains_being_blocked": 123456}
+		}`,
+		"/api/dns/blocking":      `{"blocking": "enabled"}`,
+		"/api/info/ftl":          `{"ftl": {"privacy_level": 0}}`,
+		"/api/stats/query_types": `{"types": {"A": 600, "AAAA": 300, "HTTPS": 100}}`,
+		"/api/stats/upstreams": `{"upstreams": [
+			{"ip": "blocklist", "name": "blocklist", "port": -1, "count": 100},
+			{"ip": "cache", "name": "cache", "port": -1, "count": 300},
+			{"ip": "8.8.8.8", "name": "dns.google", "port": 53, "count": 600}
+		], "total_queries": 1000}`,
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			var body struct{ Password string }
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"session": {"valid": false, "sid": null, "validity": -1, "message": "password incorrect"}}`))
+				return
+			}
+			w.Write([]byte(`{"session": {"valid": true, "sid": "abc", "validity": 300, "message": "password correct"}}`))
+			return
+		}
+
+		if r.Header.Get("X-FTL-SID") != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if resp, ok := responses[r.URL.Path]; ok {
+			w.Write([]byte(resp))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConfig(t *testing.T) {
+	env := munin.Env{"host": "http://pi.hole", "except": "privacy_level"}
+	munintest.Golden(t, "config", munintest.Config(t, new(piHole), env))
+}
+
+func TestFetch(t *testing.T) {
+	env := munin.Env{"host": fakePiHole(t).URL, "MUNIN_PLUGSTATE": t.TempDir()}
+	munintest.Golden(t, "fetch", munintest.Fetch(t, new(piHole), env))
+}
+
+func TestFetchV6(t *testing.T) {
+	env := munin.Env{"host": fakePiHole6(t).URL, "password": "secret", "MUNIN_PLUGSTATE": t.TempDir()}
+	munintest.Golden(t, "fetch", munintest.Fetch(t, new(piHole), env))
+}
+
+func TestMultigraph(t *testing.T) {
+	host := fakePiHole(t).URL
+	env := munin.Env{"host": host, "token": "t0ken", "MUNIN_PLUGSTATE": t.TempDir(), "MUNIN_CAP_MULTIGRAPH": "1"}
+	// the breakdowns are configured from what the first fetch saw
+	munintest.Golden(t, "fetch_multigraph", munintest.Fetch(t, new(piHole), env))
+	config := strings.ReplaceAll(munintest.Config(t, new(piHole), env), host, "http://pi.hole")
+	munintest.Golden(t, "config_multigraph", config)
+	munintest.FieldsMatch(t, new(piHole), env)
+}
+
+func TestMultigraphV6(t *testing.T) {
+	env := munin.Env{"host": fakePiHole6(t).URL, "password": "secret", "MUNIN_PLUGSTATE": t.TempDir(), "MUNIN_CAP_MULTIGRAPH": "1"}
+	munintest.Golden(t, "fetch_multigraph_v6", munintest.Fetch(t, new(piHole), env))
+	munintest.FieldsMatch(t, new(piHole), env)
+}
+
+func TestMultigraphWithoutToken(t *testing.T) {
+	env := munin.Env{"host": fakePiHole(t).URL, "MUNIN_PLUGSTATE": t.TempDir(), "MUNIN_CAP_MULTIGRAPH": "1", munin.PluginEnv: "pihole_pi.hole"}
+	// breakdowns saved while there was a token are forgotten once it is removed
+	env["token"] = "t0ken"
+	munintest.Fetch(t, new(piHole), env)
+	delete(env, "token")
+	munintest.Fetch(t, new(piHole), env)
+
+	want := []string{}
+	for _, field := range munintest.Fields(munintest.Config(t, new(piHole), env)) {
+		if !strings.HasPrefix(field, "pihole_pi_hole/") {
+			want = append(want, field)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("fields outside the summary graph %v, want the breakdowns to be left out", want)
+	}
+	munintest.FieldsMatch(t, new(piHole), env)
+}
+
+func TestMultigraphUnreachable(t *testing.T) {
+	env := munin.Env{"host": "http://127.0.0.1:1", "MUNIN_CAP_MULTIGRAPH": "1", "MUNIN_PLUGSTATE": t.TempDir()}
+	config := munintest.Config(t, new(piHole), env)
+	if !strings.HasPrefix(config, "multigraph plugin\ngraph_title PiHole stats - http://127.0.0.1:1\n") {
+		t.Errorf("config = %q, want just the summary graph", config)
+	}
+	if strings.Count(config, "multigraph") != 1 {
+		t.Errorf("config = %q, want the breakdowns left out", config)
+	}
+}
+
+func TestAutoConf(t *testing.T) {
+	env := munin.Env{"host": fakePiHole(t).URL, "MUNIN_PLUGSTATE": t.TempDir()}
+	munintest.Golden(t, "autoconf", munintest.AutoConf(t, new(piHole), env))
+	munintest.Golden(t, "autoconf_nohost", munintest.AutoConf(t, new(piHole), nil))
+}
+
+func TestDetectCached(t *testing.T) {
+	var probes int
+	v6 := fakePiHole6(t)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/api/auth" {
+			probes++
+		}
+		resp, err := http.Get(v6.URL + r.URL.Path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(s.Close)
+
+	env := munin.Env{"MUNIN_PLUGSTATE": t.TempDir(), munin.PluginEnv: "pihole"}
+	for i := 0; i < 3; i++ {
+		if ok, err := detect(context.Background(), env, s.URL); !ok || err != nil {
+			t.Fatalf("detect() = %v, %v, want true", ok, err)
+		}
+	}
+	if probes != 1 {
+		t.Errorf("probed %d times, want once", probes)
+	}
+
+	if ok, err := detect(context.Background(), env, v6.URL); !ok || err != nil {
+		t.Fatalf("detect() = %v, %v, want true", ok, err)
+	}
+	if ok, err := detect(context.Background(), env, s.URL); !ok || err != nil {
+		t.Fatalf("detect() = %v, %v, want true", ok, err)
+	}
+	if probes != 2 {
+		t.Errorf("probed %d times, want again after the host changed", probes)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	notPiHole := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(notPiHole.Close)
+	v5 := strings.TrimPrefix(fakePiHole(t).URL, "http://")
+	v6 := strings.TrimPrefix(fakePiHole6(t).URL, "http://")
+	other := strings.TrimPrefix(notPiHole.URL, "http://")
+
+	env := munin.Env{"suggest": v5 + ", " + other + "," + v6, "MUNIN_PLUGSTATE": t.TempDir(), munin.PluginEnv: "pihole_"}
+	out := munintest.Run(t, new(piHole), env, "suggest")
+	if want := v5 + "\n" + v6 + "\n"; out.Stdout != want {
+		t.Errorf("suggest = %q, want %q", out.Stdout, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	env := munin.Env{"host": fakePiHole(t).URL, "MUNIN_PLUGSTATE": t.TempDir()}
+	w := httptest.NewRecorder()
+	prometheus.NewHandler("pihole", new(piHole), env).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	munintest.Golden(t, "metrics", w.Body.String())
+}
+
+func TestFieldsMatch(t *testing.T) {
+	env := munin.Env{"host": fakePiHole(t).URL, "MUNIN_PLUGSTATE": t.TempDir()}
+	munintest.FieldsMatch(t, new(piHole), env)
+}
+
+func TestTokenOf(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     munin.Env
+		want    string
+		wantErr bool
+	}{
+		{"none", nil, "", false},
+		{"token", munin.Env{"token": "abc", "token_file": file}, "abc", false},
+		{"file", munin.Env{"token_file": file}, "from-file", false},
+		{"missing file", munin.Env{"token_file": file + ".missing"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenOf(tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tokenOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("tokenOf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamsChange(t *testing.T) {
+	destinations := forwardDestinationsResponse
+	var requests int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if _, ok := r.URL.Query()["getForwardDestinations"]; ok {
+			w.Write([]byte(destinations))
+			return
+		}
+		w.Write([]byte(summary))
+	}))
+	defer s.Close()
+
+	env := munin.Env{"host": s.URL, "api": "5", "token": "t0ken", "MUNIN_PLUGSTATE": t.TempDir(), "MUNIN_CAP_MULTIGRAPH": "1"}
+	munintest.Fetch(t, new(piHole), env)
+	requests = 0
+	before := munintest.Fields(munintest.Config(t, new(piHole), env))
+	if requests != 0 {
+		t.Errorf("config made %d requests, want it configured from plugin state", requests)
+	}
+
+	// 1.1.1.1 goes away and 9.9.9.9 takes its place
+	destinations = `{"forward_destinations": {"blocklist|blocklist": 10, "cache|cache": 20, "dns.google#53|8.8.8.8#53": 40, "dns.quad9.net#53|9.9.9.9#53": 30}}`
+	fetch := munintest.Fetch(t, new(piHole), env)
+	after := munintest.Fields(munintest.Config(t, new(piHole), env))
+
+	gone := "plugin.upstreams/" + upstreamField("1.1.1.1#53")
+	added := "plugin.upstreams/" + upstreamField("9.9.9.9#53")
+	if !contains(before, gone) || !contains(after, gone) {
+		t.Errorf("fields before %v and after %v, want %s in both", before, after, gone)
+	}
+	if contains(before, added) || !contains(after, added) {
+		t.Errorf("fields before %v and after %v, want %s only after", before, after, added)
+	}
+	if !strings.Contains(fetch, upstreamField("1.1.1.1#53")+".value U\n") {
+		t.Errorf("fetch = %s, want 1.1.1.1 to be unknown", fetch)
+	}
+}
+
+func contains(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUpstreamField(t *testing.T) {
+	tests := []struct {
+		key       string
+		wantLabel string
+	}{
+		{"cache|cache", "Cache"},
+		{"blocklist|blocklist", "Block list"},
+		{"dns.google#53|8.8.8.8#53", "dns.google"},
+		{"|8.8.4.4#53", "8.8.4.4"},
+		{"#53|9.9.9.9#53", "9.9.9.9"},
+		{"a|1.2.3.4", "a"},
+		{"b|1_2_3_4", "b"},
+	}
+
+	fields := make(map[string]string)
+	for _, tt := range tests {
+		field, label := parseDestination(tt.key)
+		if label != tt.wantLabel {
+			t.Errorf("parseDestination(%q) label = %q, want %q", tt.key, label, tt.wantLabel)
+		}
+		if other, ok := fields[field]; ok {
+			t.Errorf("parseDestination(%q) field %s collides with %q", tt.key, field, other)
+		}
+		fields[field] = tt.key
+
+		if again, _ := parseDestination(tt.key); again != field {
+			t.Errorf("parseDestination(%q) field = %s then %s, want it stable", tt.key, field, again)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/quells/munin/internal/env"
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/pluginconf"
+	"github.com/quells/munin/pkg/prometheus"
+)
+
+// serve the plugin's values as Prometheus metrics over HTTP until interrupted.
+// Settings come from the process environment, overridden by plugin-conf.d files if -conf is set.
+func serve(p munin.Plugin, args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", ":9617", "address to listen on")
+	name := flags.String("name", "pihole", "name to run the plugin as, e.g. pihole_pi.hole")
+	conf := flags.String("conf", "", "plugin-conf.d style file or directory")
+	flags.Parse(args)
+
+	e := munin.Env(env.Parse(os.Environ()))
+	if *conf != "" {
+		c, err := pluginconf.Read(*conf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *name, err)
+			return 1
+		}
+		for k, v := range c.Resolve(*name).Env {
+			e[k] = v
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.NewHandler(*name, p, e))
+	s := &http.Server{Addr: *listen, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+
+	log.Printf("serving metrics on %s/metrics", *listen)
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *name, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+// forwardDestinationer is a client which can break queries down by upstream resolver.
+type forwardDestinationer interface {
+	ForwardDestinations(ctx context.Context) (destinations map[string]float64, err error)
+}
+
+const upstreamsInfo = "This graph shows the percentage of DNS queries answered by each upstream resolver, the cache and the block list over a rolling 24-hour period (at the time of retrieval)."
+
+// upstreamsKey in plugin state for the upstreams seen so far.
+const upstreamsKey = "upstreams"
+
+// forgetUpstreamAfter not seeing it for this long, so replaced resolvers do not clutter the graph forever.
+const forgetUpstreamAfter = 30 * 24 * time.Hour
+
+// An upstream resolver seen by the plugin, keyed by field name in plugin state.
+type upstream struct {
+	Label    string    `json:"label"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// upstreamField name for an upstream resolver address, e.g. up_8_8_8_8_53_f500a4c6 for 8.8.8.8#53.
+// The hash of the address keeps it unique when different addresses clean to the same name,
+// and stable so the resolver stays on the same series between runs.
+// The cache and block list are not resolvers and keep their own names.
+func upstreamField(address string) string {
+	if address == "cache" || address == "blocklist" {
+		return address
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(address))
+	return fmt.Sprintf("%s_%08x", munin.CleanFieldName("up_"+address), h.Sum32())
+}
+
+// parseDestination key from the API, "name|address", into a field name and label.
+func parseDestination(key string) (field, label string) {
+	parts := strings.SplitN(key, "|", 2)
+	name, address := parts[0], parts[0]
+	if len(parts) == 2 {
+		address = parts[1]
+	}
+
+	switch {
+	case address == "cache":
+		label = "Cache"
+	case address == "blocklist":
+		label = "Block list"
+	default:
+		// upstreams without a hostname are labelled with their address
+		if label = strings.SplitN(name, "#", 2)[0]; label == "" {
+			label = strings.SplitN(address, "#", 2)[0]
+		}
+	}
+	return upstreamField(address), label
+}
+
+// upstreams with the current percentage for each one, saving them with those seen in earlier runs
+// for upstreamsConfig, or false if the client cannot break queries down by upstream,
+// like the v5 API without a token. The saved upstreams are cleared if the client can no longer
+// break queries down, so the graph is not configured with only unknown values.
+func upstreams(ctx context.Context, env munin.Env, client statsClient) (values munin.Values, ok bool, err error) {
+	fd, ok := client.(forwardDestinationer)
+	if !ok {
+		return nil, false, clearUpstreams(env)
+	}
+
+	destinations, err := fd.ForwardDestinations(ctx)
+	var confErr *munin.ConfigError
+	if errors.As(err, &confErr) {
+		return nil, false, clearUpstreams(env)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	values = make(munin.Values, len(destinations))
+	var seen map[string]upstream
+	err = env.State().Update(upstreamsKey, &seen, func(found bool) error {
+		if seen == nil {
+			seen = make(map[string]upstream)
+		}
+		for key, percent := range destinations {
+			field, label := parseDestination(key)
+			values[field] = percent
+			seen[field] = upstream{Label: label, LastSeen: now}
+		}
+		forgetUpstreams(seen, now)
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("saving upstreams: %w", err)
+	}
+	return values, true, nil
+}
+
+// clearUpstreams saved by earlier fetches.
+func clearUpstreams(env munin.Env) error {
+	if err := env.State().Save(upstreamsKey, map[string]upstream{}); err != nil {
+		return fmt.Errorf("saving upstreams: %w", err)
+	}
+	return nil
+}
+
+// savedUpstreams seen by fetches within forgetUpstreamAfter. Upstreams which have gone away
+// are kept for a while, so their series are reported as unknown instead of disappearing from the graph.
+func savedUpstreams(env munin.Env) (seen map[string]upstream) {
+	if _, err := env.State().Load(upstreamsKey, &seen); err != nil {
+		return nil
+	}
+	forgetUpstreams(seen, time.Now())
+	return
+}
+
+// forgetUpstreams not seen for forgetUpstreamAfter.
+func forgetUpstreams(seen map[string]upstream, now time.Time) {
+	for field, u := range seen {
+		if now.Sub(u.LastSeen) > forgetUpstreamAfter {
+			delete(seen, field)
+		}
+	}
+}
+
+// upstreamsConfig with a stacked series for each upstream,
+// after the cache and block list.
+func upstreamsConfig(env munin.Env, seen map[string]upstream) munin.Config {
+	conf := munin.Config{
+		Title:    "PiHole upstreams - " + hostOf(env),
+		Category: "dns",
+		Info:     upstreamsInfo,
+		YAxis:    "%",
+		Series:   make(map[string]munin.Series, len(seen)),
+	}.WithLimits(0, 100)
+	conf.Rigid = true
+
+	fields := make([]string, 0, len(seen))
+	for field, u := range seen {
+		fields = append(fields, field)
+		conf.Series[field] = munin.NewSeries(u.Label).
+			WithType(munin.Gauge).
+			WithDraw(munin.AreaStack).
+			WithRange(0, 100)
+	}
+	rank := func(field string) int {
+		switch field {
+		case "cache":
+			return 0
+		case "blocklist":
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i], fields[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if seen[a].Label != seen[b].Label {
+			return seen[a].Label < seen[b].Label
+		}
+		return a < b
+	})
+
+	return conf.WithOrder(fields...)
+}
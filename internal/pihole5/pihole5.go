@@ -21,66 +21,186 @@
 package pihole5
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/quells/munin/internal/set"
 	"github.com/quells/munin/pkg/munin"
 )
 
+// httpClient gives up on a Pi-Hole which does not respond,
+// in case the caller did not set a deadline.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
 type Client struct {
-	host string
-	skip set.Strings
+	host  string
+	token string
+	skip  set.Strings
 }
 
-func NewClient(host string, skip set.Strings) *Client {
+// NewClient for the Pi-Hole at host. The API token, from the web interface settings,
+// is needed for everything but the summary, and for the summary too on some installs.
+func NewClient(host, token string, skip set.Strings) *Client {
 	c := new(Client)
 	c.host = host
+	c.token = token
 	c.skip = skip
 	return c
 }
 
 func (c *Client) Load() (values munin.Values, precision munin.Precision, err error) {
+	return c.LoadContext(context.Background())
+}
+
+func (c *Client) LoadContext(ctx context.Context) (values munin.Values, precision munin.Precision, err error) {
 	if c == nil {
 		err = fmt.Errorf("nil pihole5 config")
 		return
 	}
 
-	u := fmt.Sprintf("%s/admin/api.php?summary", c.host)
+	respBody := make(map[string]interface{})
+	if err = c.get(ctx, "summary", &respBody); err != nil {
+		return
+	}
 
-	var req *http.Request
-	req, err = http.NewRequest(http.MethodGet, u, nil)
-	if err != nil {
+	var invalid []string
+	values, precision, invalid = c.filter(respBody)
+	if len(invalid) != 0 {
+		err = &munin.PartialError{Err: fmt.Errorf("invalid values for %s", strings.Join(invalid, ", "))}
+	}
+	return
+}
+
+// QueryTypes returns the percentage of queries of each type over the last 24 hours,
+// keyed by the names used by the API, e.g. "A (IPv4)".
+func (c *Client) QueryTypes(ctx context.Context) (types map[string]float64, err error) {
+	var resp struct {
+		QueryTypes map[string]float64 `json:"querytypes"`
+	}
+	if err = c.get(ctx, "getQueryTypes", &resp); err != nil {
 		return
 	}
+	return resp.QueryTypes, nil
+}
 
-	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
+// ForwardDestinations returns the percentage of queries answered by each upstream resolver
+// over the last 24 hours, keyed by "name|address", including "cache|cache" and "blocklist|blocklist".
+func (c *Client) ForwardDestinations(ctx context.Context) (destinations map[string]float64, err error) {
+	var resp struct {
+		ForwardDestinations map[string]float64 `json:"forward_destinations"`
+	}
+	if err = c.get(ctx, "getForwardDestinations", &resp); err != nil {
+		return
+	}
+	return resp.ForwardDestinations, nil
+}
+
+// TopItems are the most queried domains, by number of queries over the last 24 hours.
+type TopItems struct {
+	Queries map[string]int `json:"top_queries"`
+	Ads     map[string]int `json:"top_ads"`
+}
+
+// TopItems returns the n most queried permitted and blocked domains.
+func (c *Client) TopItems(ctx context.Context, n int) (items TopItems, err error) {
+	err = c.get(ctx, "topItems="+strconv.Itoa(n), &items)
+	return
+}
+
+// TopClients returns the n clients with the most queries over the last 24 hours, keyed by "name|address".
+func (c *Client) TopClients(ctx context.Context, n int) (clients map[string]int, err error) {
+	var resp struct {
+		TopSources map[string]int `json:"top_sources"`
+	}
+	if err = c.get(ctx, "topClients="+strconv.Itoa(n), &resp); err != nil {
 		return
 	}
+	return resp.TopSources, nil
+}
+
+// get the API response for query into v, authenticating with the token if there is one.
+// Errors never include the token, since they end up in munin-node logs.
+func (c *Client) get(ctx context.Context, query string, v interface{}) (err error) {
+	u := fmt.Sprintf("%s/admin/api.php?%s", c.host, query)
+	if c.token != "" {
+		u += "&auth=" + url.QueryEscape(c.token)
+	}
 
-	var respData []byte
-	respData, err = ioutil.ReadAll(resp.Body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return c.redact(err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return &munin.TransientError{Err: c.redact(err)}
+	}
+
+	respData, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return
+		return &munin.TransientError{Err: c.redact(err)}
 	}
 
-	respBody := make(map[string]interface{})
-	if err = json.Unmarshal(respData, &respBody); err != nil {
-		return
+	if resp.StatusCode != http.StatusOK {
+		return &munin.TransientError{Err: fmt.Errorf("%s responded %s", c.host, resp.Status)}
 	}
 
-	values, precision = c.filter(respBody)
-	return
+	// the API responds with an empty array when it needs a token
+	if bytes.Equal(bytes.TrimSpace(respData), []byte("[]")) {
+		if c.token == "" {
+			return &munin.ConfigError{Err: fmt.Errorf("%s requires an API token, set env.token", c.host)}
+		}
+		return &munin.ConfigError{Err: fmt.Errorf("%s rejected env.token", c.host)}
+	}
+
+	if err = json.Unmarshal(respData, v); err != nil {
+		return &munin.TransientError{Err: fmt.Errorf("%s responded with invalid JSON: %w", c.host, err)}
+	}
+	return nil
+}
+
+// redact the token from err, which may include the request URL.
+func (c *Client) redact(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			q := u.Query()
+			if q.Get("auth") != "" {
+				q.Set("auth", "REDACTED")
+				u.RawQuery = q.Encode()
+			}
+			urlErr.URL = u.String()
+		}
+	}
+	if c.token == "" {
+		return err
+	}
+	// the URL carries the escaped token, while other messages may carry it as is
+	msg := err.Error()
+	for _, t := range []string{url.QueryEscape(c.token), c.token} {
+		msg = strings.ReplaceAll(msg, t, "REDACTED")
+	}
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
 }
 
-func (c *Client) filter(raw map[string]interface{}) (values munin.Values, precision munin.Precision) {
+// filter the summary down to numeric values, leaving out those which fail to parse.
+// Those in the plugin's Config are still reported as unknown by munin.Run,
+// without adding fields Munin was never configured for.
+func (c *Client) filter(raw map[string]interface{}) (values munin.Values, precision munin.Precision, invalid []string) {
 	values = make(munin.Values)
 
 	for k, vint := range raw {
@@ -100,9 +220,12 @@ func (c *Client) filter(raw map[string]interface{}) (values munin.Values, precis
 
 			if x, err := strconv.Atoi(strings.ReplaceAll(vstr, ",", "")); err == nil {
 				values[k] = float64(x)
+			} else {
+				invalid = append(invalid, k)
 			}
 		}
 	}
 
+	sort.Strings(invalid)
 	return
 }
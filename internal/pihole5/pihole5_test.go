@@ -0,0 +1,156 @@
+package pihole5
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+const token = "s3cr3t"
+
+var responses = map[string]string{
+	"summary":                `{"dns_queries_today": "7,890", "status": "enabled"}`,
+	"getQueryTypes":          `{"querytypes": {"A (IPv4)": 63.5, "AAAA (IPv6)": 20.1, "PTR": 14.2, "HTTPS": 2.2}}`,
+	"getForwardDestinations": `{"forward_destinations": {"blocklist|blocklist": 9.5, "cache|cache": 20.1, "dns.google#53|8.8.8.8#53": 70.4}}`,
+	"topItems":               `{"top_queries": {"example.com": 12}, "top_ads": {"ads.example.com": 3}}`,
+	"topClients":             `{"top_sources": {"laptop|192.168.1.10": 120}}`,
+}
+
+// fakePiHole responds to every API request with the token, and with an empty array without it,
+// as Pi-Hole v5 does.
+func fakePiHole(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/admin/api.php" || q.Get("auth") != token {
+			w.Write([]byte("[]"))
+			return
+		}
+		for key, resp := range responses {
+			if _, ok := q[key]; ok {
+				w.Write([]byte(resp))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestLoad(t *testing.T) {
+	c := NewClient(fakePiHole(t).URL, token, nil)
+	values, _, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := munin.Values{"dns_queries_today": 7890, "status": 1}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Load() = %v, want %v", values, want)
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	c := NewClient("http://pi.hole", token, nil)
+	values, _, invalid := c.filter(map[string]interface{}{
+		"dns_queries_today": "n/a",
+		"unique_clients":    "10",
+		"gravity_text":      "yesterday",
+	})
+
+	if want := (munin.Values{"unique_clients": 10}); !reflect.DeepEqual(values, want) {
+		t.Errorf("filter() values = %v, want %v", values, want)
+	}
+	if want := []string{"dns_queries_today", "gravity_text"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("filter() invalid = %v, want %v", invalid, want)
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	c := NewClient(fakePiHole(t).URL, token, nil)
+	ctx := context.Background()
+
+	types, err := c.QueryTypes(ctx)
+	if want := map[string]float64{"A (IPv4)": 63.5, "AAAA (IPv6)": 20.1, "PTR": 14.2, "HTTPS": 2.2}; err != nil || !reflect.DeepEqual(types, want) {
+		t.Errorf("QueryTypes() = %v, %v, want %v", types, err, want)
+	}
+
+	destinations, err := c.ForwardDestinations(ctx)
+	if want := map[string]float64{"blocklist|blocklist": 9.5, "cache|cache": 20.1, "dns.google#53|8.8.8.8#53": 70.4}; err != nil || !reflect.DeepEqual(destinations, want) {
+		t.Errorf("ForwardDestinations() = %v, %v, want %v", destinations, err, want)
+	}
+
+	items, err := c.TopItems(ctx, 10)
+	if want := (TopItems{Queries: map[string]int{"example.com": 12}, Ads: map[string]int{"ads.example.com": 3}}); err != nil || !reflect.DeepEqual(items, want) {
+		t.Errorf("TopItems() = %v, %v, want %v", items, err, want)
+	}
+
+	clients, err := c.TopClients(ctx, 10)
+	if want := map[string]int{"laptop|192.168.1.10": 120}; err != nil || !reflect.DeepEqual(clients, want) {
+		t.Errorf("TopClients() = %v, %v, want %v", clients, err, want)
+	}
+}
+
+func TestTokenErrors(t *testing.T) {
+	host := fakePiHole(t).URL
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		host      string
+		token     string
+		wantError string
+	}{
+		{"no token", host, "", host + " requires an API token, set env.token"},
+		{"wrong token", host, "wrong", host + " rejected env.token"},
+		{"unreachable", closed.URL, token, "REDACTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := NewClient(tt.host, tt.token, nil).Load()
+			if err == nil {
+				t.Fatal("Load() error = nil")
+			}
+			if !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("Load() error = %q, want %q", err, tt.wantError)
+			}
+			if strings.Contains(err.Error(), token) {
+				t.Errorf("Load() error = %q, leaks the token", err)
+			}
+
+			var confErr *munin.ConfigError
+			var transientErr *munin.TransientError
+			if !errors.As(err, &confErr) && !errors.As(err, &transientErr) {
+				t.Errorf("Load() error = %T, want a ConfigError or TransientError", err)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	const token = "s3cr3t/+&="
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"url", &url.Error{Op: "Get", URL: "http://pi.hole/admin/api.php?auth=" + url.QueryEscape(token), Err: errors.New("refused")}},
+		{"unparsable url", &url.Error{Op: "Get", URL: "http://pi.hole\x7f/admin/api.php?auth=" + url.QueryEscape(token), Err: errors.New("refused")}},
+		{"plain", errors.New("token " + token + " rejected")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewClient("http://pi.hole", token, nil).redact(tt.err)
+			if msg := err.Error(); strings.Contains(msg, token) || strings.Contains(msg, url.QueryEscape(token)) {
+				t.Errorf("redact() = %q, leaks the token", msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package pihole6 reads stats from the REST API introduced in Pi-hole v6,
+// which replaced the admin/api.php endpoint read by pihole5.
+package pihole6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/quells/munin/internal/set"
+	"github.com/quells/munin/pkg/munin"
+)
+
+// httpClient for Detect, logins and API requests. Its timeout only matters for callers like
+// the Prometheus exporter whose context has no deadline, since Run sets one from env.timeout.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// sessionKey the session is cached under in plugin state.
+const sessionKey = "pihole6-session"
+
+// renewMargin before a session expires when it is replaced rather than reused,
+// so it does not expire part way through a run.
+const renewMargin = 30 * time.Second
+
+type Client struct {
+	host     string
+	password string
+	skip     set.Strings
+	state    *munin.State
+
+	sess session
+}
+
+// session with the Pi-Hole, cached between runs since Pi-Hole limits how many can be open at once.
+type session struct {
+	Host    string    `json:"host"`
+	SID     string    `json:"sid"`
+	Expires time.Time `json:"expires"`
+
+	// Validity of the session after each request, which extends it.
+	Validity time.Duration `json:"validity"`
+}
+
+func (s session) valid(host string) bool {
+	return s.Host == host && s.SID != "" && time.Now().Add(renewMargin).Before(s.Expires)
+}
+
+// NewClient for the Pi-Hole at host, authenticating with password, which may be an app password.
+// An empty password is only accepted by a Pi-Hole without one.
+// Sessions are cached in state between runs, or only for the life of the Client if state is nil.
+func NewClient(host, password string, skip set.Strings, state *munin.State) *Client {
+	c := new(Client)
+	c.host = host
+	c.password = password
+	c.skip = skip
+	c.state = state
+	return c
+}
+
+// Detect whether the Pi-Hole at host speaks the v6 API,
+// by checking for the auth endpoint, which responds without a session.
+func Detect(ctx context.Context, host string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, host+"/api/auth", nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, &munin.TransientError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return false, nil
+	}
+
+	var body authResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, nil
+	}
+	return body.Session != nil, nil
+}
+
+type authResponse struct {
+	Session *struct {
+		Valid    bool    `json:"valid"`
+		SID      *string `json:"sid"`
+		Validity int     `json:"validity"`
+		Message  string  `json:"message"`
+	} `json:"session"`
+}
+
+type summaryResponse struct {
+	Queries struct {
+		Total         float64            `json:"total"`
+		Blocked       float64            `json:"blocked"`
+		UniqueDomains float64            `json:"unique_domains"`
+		Forwarded     float64            `json:"forwarded"`
+		Cached        float64            `json:"cached"`
+		Replies       map[string]float64 `json:"replies"`
+	} `json:"queries"`
+	Clients struct {
+		Active float64 `json:"active"`
+		Total  float64 `json:"total"`
+	} `json:"clients"`
+	Gravity struct {
+		DomainsBeingBlocked float64 `json:"domains_being_blocked"`
+	} `json:"gravity"`
+}
+
+func (r authResponse) message() string {
+	if r.Session == nil || r.Session.Message == "" {
+		return "no reason given"
+	}
+	return r.Session.Message
+}
+
+type blockingResponse struct {
+	Blocking string `json:"blocking"`
+}
+
+type ftlResponse struct {
+	FTL struct {
+		PrivacyLevel float64 `json:"privacy_level"`
+	} `json:"ftl"`
+}
+
+func (c *Client) Load() (values munin.Values, precision munin.Precision, err error) {
+	return c.LoadContext(context.Background())
+}
+
+// LoadContext values with the same keys as pihole5, so either can back the same graph.
+func (c *Client) LoadContext(ctx context.Context) (values munin.Values, precision munin.Precision, err error) {
+	if c == nil {
+		err = fmt.Errorf("nil pihole6 config")
+		return
+	}
+
+	var summary summaryResponse
+	if err = c.get(ctx, "/api/stats/summary", &summary); err != nil {
+		return
+	}
+	var blocking blockingResponse
+	if err = c.get(ctx, "/api/dns/blocking", &blocking); err != nil {
+		return
+	}
+	var ftl ftlResponse
+	if err = c.get(ctx, "/api/info/ftl", &ftl); err != nil {
+		return
+	}
+	c.saveSession()
+
+	status := 0.0
+	if blocking.Blocking == "enabled" {
+		status = 1
+	}
+
+	all := munin.Values{
+		"domains_being_blocked": summary.Gravity.DomainsBeingBlocked,
+		"dns_queries_today":     summary.Queries.Total,
+		"ads_blocked_today":     summary.Queries.Blocked,
+		"unique_domains":        summary.Queries.UniqueDomains,
+		"queries_forwarded":     summary.Queries.Forwarded,
+		"queries_cached":        summary.Queries.Cached,
+		"clients_ever_seen":     summary.Clients.Total,
+		"unique_clients":        summary.Clients.Active,
+		"dns_queries_all_types": summary.Queries.Total,
+		"reply_NODATA":          summary.Queries.Replies["NODATA"],
+		"reply_NXDOMAIN":        summary.Queries.Replies["NXDOMAIN"],
+		"reply_CNAME":           summary.Queries.Replies["CNAME"],
+		"reply_IP":              summary.Queries.Replies["IP"],
+		"privacy_level":         ftl.FTL.PrivacyLevel,
+		"status":                status,
+	}
+
+	values = make(munin.Values, len(all))
+	for k, v := range all {
+		if _, skip := c.skip[k]; !skip {
+			values[k] = v
+		}
+	}
+	return
+}
+
+// QueryTypes returns the percentage of queries of each type over the last 24 hours,
+// keyed by the names used by the API, e.g. "A", like pihole5.Client.QueryTypes.
+func (c *Client) QueryTypes(ctx context.Context) (types map[string]float64, err error) {
+	var resp struct {
+		Types map[string]float64 `json:"types"`
+	}
+	if err = c.get(ctx, "/api/stats/query_types", &resp); err != nil {
+		return
+	}
+	c.saveSession()
+
+	var total float64
+	for _, count := range resp.Types {
+		total += count
+	}
+
+	types = make(map[string]float64, len(resp.Types))
+	for name, count := range resp.Types {
+		if total == 0 {
+			types[name] = 0
+		} else {
+			types[name] = count / total * 100
+		}
+	}
+	return
+}
+
+// ForwardDestinations returns the percentage of queries answered by each upstream resolver
+// over the last 24 hours, keyed by "name|address" like pihole5.Client.ForwardDestinations,
+// including "cache|cache" and "blocklist|blocklist".
+func (c *Client) ForwardDestinations(ctx context.Context) (destinations map[string]float64, err error) {
+	var resp struct {
+		Upstreams []struct {
+			IP    string  `json:"ip"`
+			Name  string  `json:"name"`
+			Port  int     `json:"port"`
+			Count float64 `json:"count"`
+		} `json:"upstreams"`
+		TotalQueries float64 `json:"total_queries"`
+	}
+	if err = c.get(ctx, "/api/stats/upstreams", &resp); err != nil {
+		return
+	}
+	c.saveSession()
+
+	destinations = make(map[string]float64, len(resp.Upstreams))
+	for _, u := range resp.Upstreams {
+		name, ip := u.Name, u.IP
+		if u.Port > 0 {
+			if name != "" {
+				name = fmt.Sprintf("%s#%d", name, u.Port)
+			}
+			ip = fmt.Sprintf("%s#%d", ip, u.Port)
+		}
+		key := name + "|" + ip
+		if resp.TotalQueries == 0 {
+			destinations[key] = 0
+		} else {
+			destinations[key] = u.Count / resp.TotalQueries * 100
+		}
+	}
+	return
+}
+
+// get path from the API into v, logging in again if the session has expired.
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	sid, err := c.sessionID(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	status, data, err := c.do(ctx, http.MethodGet, path, sid, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized && c.password != "" {
+		// the session expired or was logged out on the Pi-Hole
+		if sid, err = c.sessionID(ctx, sid); err != nil {
+			return err
+		}
+		if status, data, err = c.do(ctx, http.MethodGet, path, sid, nil); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case status == http.StatusUnauthorized && c.password == "":
+		return &munin.ConfigError{Err: fmt.Errorf("%s requires a password, set env.password", c.host)}
+	case status != http.StatusOK:
+		return &munin.TransientError{Err: fmt.Errorf("%s%s responded %d %s", c.host, path, status, http.StatusText(status))}
+	}
+
+	c.extend()
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return &munin.TransientError{Err: fmt.Errorf("%s%s responded with invalid JSON: %w", c.host, path, err)}
+	}
+	return nil
+}
+
+// do a request with the session ID, returning the status and body.
+// Only failures to reach the Pi-Hole are returned as errors.
+func (c *Client) do(ctx context.Context, method, path, sid string, body interface{}) (status int, data []byte, err error) {
+	var reqBody io.Reader
+	if body != nil {
+		var b []byte
+		if b, err = json.Marshal(body); err != nil {
+			return
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, reqBody)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if sid != "" {
+		req.Header.Set("X-FTL-SID", sid)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		err = &munin.TransientError{Err: err}
+		return
+	}
+	defer resp.Body.Close()
+
+	if data, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = &munin.TransientError{Err: err}
+		return
+	}
+	return resp.StatusCode, data, nil
+}
+
+// sessionID to authenticate requests with, reusing a cached session unless it is stale.
+// Returns an empty ID if no password is set.
+func (c *Client) sessionID(ctx context.Context, stale string) (string, error) {
+	if c.password == "" {
+		return "", nil
+	}
+	if c.sess.valid(c.host) && c.sess.SID != stale {
+		return c.sess.SID, nil
+	}
+
+	if c.state == nil {
+		sess, err := c.login(ctx)
+		if err != nil {
+			return "", err
+		}
+		c.sess = sess
+		return sess.SID, nil
+	}
+
+	// Hold the state lock while logging in, so concurrent runs share one session
+	// instead of each opening their own.
+	var sess session
+	err := c.state.Update(sessionKey, &sess, func(found bool) (err error) {
+		if found && sess.valid(c.host) && sess.SID != stale {
+			return
+		}
+		sess, err = c.login(ctx)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	c.sess = sess
+	return sess.SID, nil
+}
+
+// login with the password to start a new session.
+func (c *Client) login(ctx context.Context) (sess session, err error) {
+	status, data, err := c.do(ctx, http.MethodPost, "/api/auth", "", map[string]string{"password": c.password})
+	if err != nil {
+		return
+	}
+
+	var body authResponse
+	jsonErr := json.Unmarshal(data, &body)
+	switch {
+	case status == http.StatusUnauthorized:
+		err = &munin.ConfigError{Err: fmt.Errorf("%s rejected env.password: %s", c.host, body.message())}
+		return
+	case status != http.StatusOK:
+		err = &munin.TransientError{Err: fmt.Errorf("%s/api/auth responded %d %s", c.host, status, http.StatusText(status))}
+		return
+	case jsonErr != nil:
+		err = &munin.TransientError{Err: fmt.Errorf("%s/api/auth responded with invalid JSON: %w", c.host, jsonErr)}
+		return
+	case body.Session == nil || !body.Session.Valid:
+		err = &munin.ConfigError{Err: fmt.Errorf("%s rejected env.password: %s", c.host, body.message())}
+		return
+	}
+
+	sess.Host = c.host
+	if body.Session.SID != nil {
+		// otherwise the Pi-Hole has no password and requests need no session
+		sess.SID = *body.Session.SID
+	}
+	sess.Validity = time.Duration(body.Session.Validity) * time.Second
+	sess.Expires = time.Now().Add(sess.Validity)
+	return
+}
+
+// extend the session after a successful request, since the Pi-Hole extends it too.
+func (c *Client) extend() {
+	if c.sess.SID != "" {
+		c.sess.Expires = time.Now().Add(c.sess.Validity)
+	}
+}
+
+// saveSession with its new expiry, unless another run has replaced it since.
+// Failing to cache the session only costs a login next time, so errors are ignored.
+func (c *Client) saveSession() {
+	if c.state == nil || c.sess.SID == "" {
+		return
+	}
+
+	var sess session
+	c.state.Update(sessionKey, &sess, func(found bool) error {
+		if sess.SID != c.sess.SID {
+			return errReplaced
+		}
+		sess.Expires = c.sess.Expires
+		return nil
+	})
+}
+
+var errReplaced = errors.New("session replaced")
@@ -0,0 +1,235 @@
+package pihole6
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/quells/munin/internal/set"
+	"github.com/quells/munin/pkg/munin"
+)
+
+const summary = `{
+	"queries": {
+		"total": 7890,
+		"blocked": 1234,
+		"percent_blocked": 15.6,
+		"unique_domains": 2345,
+		"forwarded": 3456,
+		"cached": 2100,
+		"replies": {"NODATA": 45, "NXDOMAIN": 67, "CNAME": 1234, "IP": 4567}
+	},
+	"clients": {"active": 10, "total": 12},
+	"gravity": {"domains_being_blocked": 123456, "last_update": 1725194639},
+	"took": 0.003
+}`
+
+// fakePiHole speaks enough of the v6 API for the Client, with the password "secret".
+type fakePiHole struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	sid    string
+	logins int
+}
+
+func newFakePiHole(t *testing.T) *fakePiHole {
+	f := new(fakePiHole)
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakePiHole) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/api/auth" {
+		var body struct{ Password string }
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != http.MethodPost || body.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"session": {"valid": false, "totp": false, "sid": null, "validity": -1, "message": "password incorrect"}}`)
+			return
+		}
+
+		f.logins++
+		f.sid = fmt.Sprintf("sid%d", f.logins)
+		fmt.Fprintf(w, `{"session": {"valid": true, "totp": false, "sid": %q, "validity": 300, "message": "password correct"}}`, f.sid)
+		return
+	}
+
+	if f.sid == "" || r.Header.Get("X-FTL-SID") != f.sid {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"key": "unauthorized", "message": "Unauthorized"}}`)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/stats/summary":
+		fmt.Fprint(w, summary)
+	case "/api/stats/query_types":
+		fmt.Fprint(w, `{"types": {"A": 600, "AAAA": 300, "HTTPS": 100, "SRV": 0}}`)
+	case "/api/stats/upstreams":
+		fmt.Fprint(w, `{"upstreams": [
+			{"ip": "blocklist", "name": "blocklist", "port": -1, "count": 100},
+			{"ip": "cache", "name": "cache", "port": -1, "count": 300},
+			{"ip": "8.8.8.8", "name": "dns.google", "port": 53, "count": 600},
+			{"ip": "9.9.9.9", "name": "", "port": 53, "count": 0}
+		], "forwarded_queries": 600, "total_queries": 1000}`)
+	case "/api/dns/blocking":
+		fmt.Fprint(w, `{"blocking": "enabled", "timer": null}`)
+	case "/api/info/ftl":
+		fmt.Fprint(w, `{"ftl": {"privacy_level": 0}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// logout every session, as if they expired.
+func (f *fakePiHole) logout() {
+	f.mu.Lock()
+	f.sid = ""
+	f.mu.Unlock()
+}
+
+func TestLoad(t *testing.T) {
+	f := newFakePiHole(t)
+	c := NewClient(f.URL, "secret", set.OfStrings([]string{"privacy_level"}), nil)
+
+	values, _, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := munin.Values{
+		"domains_being_blocked": 123456,
+		"dns_queries_today":     7890,
+		"ads_blocked_today":     1234,
+		"unique_domains":        2345,
+		"queries_forwarded":     3456,
+		"queries_cached":        2100,
+		"clients_ever_seen":     12,
+		"unique_clients":        10,
+		"dns_queries_all_types": 7890,
+		"reply_NODATA":          45,
+		"reply_NXDOMAIN":        67,
+		"reply_CNAME":           1234,
+		"reply_IP":              4567,
+		"status":                1,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Load() = %v, want %v", values, want)
+	}
+}
+
+func TestSession(t *testing.T) {
+	f := newFakePiHole(t)
+	state := munin.Env{"MUNIN_PLUGSTATE": t.TempDir(), munin.PluginEnv: "pihole"}.State()
+
+	load := func() {
+		t.Helper()
+		if _, _, err := NewClient(f.URL, "secret", nil, state).Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load()
+	load()
+	if f.logins != 1 {
+		t.Errorf("logins = %d, want the session to be reused", f.logins)
+	}
+
+	f.logout()
+	load()
+	if f.logins != 2 {
+		t.Errorf("logins = %d, want the session to be renewed", f.logins)
+	}
+	load()
+	if f.logins != 2 {
+		t.Errorf("logins = %d, want the renewed session to be reused", f.logins)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	f := newFakePiHole(t)
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"wrong password", "hunter2", f.URL + " rejected env.password: password incorrect"},
+		{"no password", "", f.URL + " requires a password, set env.password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := NewClient(f.URL, tt.password, nil, nil).Load()
+
+			var confErr *munin.ConfigError
+			if !errors.As(err, &confErr) {
+				t.Fatalf("Load() error = %v, want a ConfigError", err)
+			}
+			if confErr.Err.Error() != tt.want {
+				t.Errorf("Load() error = %q, want %q", confErr.Err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	v5 := httptest.NewServer(http.NotFoundHandler())
+	defer v5.Close()
+
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{"v6", newFakePiHole(t).URL, true},
+		{"v5", v5.URL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Detect(context.Background(), tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTypes(t *testing.T) {
+	c := NewClient(newFakePiHole(t).URL, "secret", nil, nil)
+	types, err := c.QueryTypes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{"A": 60, "AAAA": 30, "HTTPS": 10, "SRV": 0}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("QueryTypes() = %v, want %v", types, want)
+	}
+}
+
+func TestForwardDestinations(t *testing.T) {
+	c := NewClient(newFakePiHole(t).URL, "secret", nil, nil)
+	destinations, err := c.ForwardDestinations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{"blocklist|blocklist": 10, "cache|cache": 30, "dns.google#53|8.8.8.8#53": 60, "|9.9.9.9#53": 0}
+	if !reflect.DeepEqual(destinations, want) {
+		t.Errorf("ForwardDestinations() = %v, want %v", destinations, want)
+	}
+}
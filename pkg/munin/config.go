@@ -24,7 +24,10 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type GraphType int
@@ -54,11 +57,82 @@ func (t GraphType) String() string {
 		return "GAUGE"
 	case Counter:
 		return "COUNTER"
+	case Derive:
+		return "DERIVE"
+	case Absolute:
+		return "ABSOLUTE"
 	default:
 		return ""
 	}
 }
 
+// ParseGraphType from its Munin name, e.g. "DERIVE".
+// An empty string is the Default type.
+func ParseGraphType(text string) (t GraphType, err error) {
+	switch strings.ToUpper(text) {
+	case "":
+		t = Default
+	case "GAUGE":
+		t = Gauge
+	case "COUNTER":
+		t = Counter
+	case "DERIVE":
+		t = Derive
+	case "ABSOLUTE":
+		t = Absolute
+	default:
+		err = fmt.Errorf("unknown graph type %q", text)
+	}
+	return
+}
+
+func (t GraphType) MarshalText() ([]byte, error) {
+	if t < Default || t > Absolute {
+		return nil, fmt.Errorf("unknown graph type %d", int(t))
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *GraphType) UnmarshalText(text []byte) (err error) {
+	*t, err = ParseGraphType(string(text))
+	return
+}
+
+// DrawStyle for a Series on a Munin graph.
+type DrawStyle string
+
+const (
+	// Line1 draws a thin line. This is the Munin default.
+	Line1 DrawStyle = "LINE1"
+	Line2 DrawStyle = "LINE2"
+	Line3 DrawStyle = "LINE3"
+
+	// Area fills the space between the line and the x-axis.
+	Area DrawStyle = "AREA"
+
+	// Stack draws the line on top of the previous series.
+	Stack DrawStyle = "STACK"
+
+	// AreaStack fills the space between the line and the previous series.
+	AreaStack DrawStyle = "AREASTACK"
+
+	// LineStack1 draws a thin line on top of the previous series.
+	LineStack1 DrawStyle = "LINESTACK1"
+	LineStack2 DrawStyle = "LINESTACK2"
+	LineStack3 DrawStyle = "LINESTACK3"
+)
+
+func (d DrawStyle) valid() bool {
+	switch d {
+	case "", Line1, Line2, Line3, Area, Stack, AreaStack, LineStack1, LineStack2, LineStack3:
+		return true
+	default:
+		return false
+	}
+}
+
+var colour = regexp.MustCompile(`^[0-9A-Fa-f]{6}$`)
+
 // A Series is a single line on a Munin graph.
 type Series struct {
 	// Label is the human readable name for what the series represents.
@@ -82,6 +156,35 @@ type Series struct {
 
 	// Crit (critical) alarm if the value for this series is above this value.
 	Crit float64
+
+	// WarnMin warns if the value for this series is below this value.
+	WarnMin float64
+
+	// CritMin (critical) alarms if the value for this series is below this value.
+	CritMin float64
+
+	// Draw style of the series. See DrawStyle for options.
+	Draw DrawStyle
+
+	// Colour of the series as a hex RRGGBB string, e.g. "00CC00".
+	Colour string
+
+	// Negative is the field name of a series to draw below the x-axis, paired with this one.
+	// The other series is usually hidden with WithoutGraph.
+	Negative string
+
+	// NoGraph hides the series from the graph while still recording its values.
+	NoGraph bool
+
+	// CDef is an RPN expression used to compute the plotted value, e.g. "x,8,*".
+	CDef string
+
+	// ExtInfo is extended information shown alongside warnings and criticals.
+	ExtInfo string
+
+	// Sum lists the field names of series whose values are added together to make this series.
+	// Series of other plugins are referenced as "plugin.field".
+	Sum []string
 }
 
 // NewSeries with a label and nothing else.
@@ -91,6 +194,8 @@ func NewSeries(label string) (s Series) {
 	s.Max = math.NaN()
 	s.Warn = math.NaN()
 	s.Crit = math.NaN()
+	s.WarnMin = math.NaN()
+	s.CritMin = math.NaN()
 	return
 }
 
@@ -116,6 +221,123 @@ func (s Series) WithWarnings(warn, crit float64) Series {
 	return s
 }
 
+// WithWarningRange warns when the value is outside of min:max.
+// Either side may be NaN to leave it open.
+func (s Series) WithWarningRange(min, max float64) Series {
+	s.WarnMin = min
+	s.Warn = max
+	return s
+}
+
+// WithCriticalRange alarms when the value is outside of min:max.
+// Either side may be NaN to leave it open.
+func (s Series) WithCriticalRange(min, max float64) Series {
+	s.CritMin = min
+	s.Crit = max
+	return s
+}
+
+func (s Series) WithDraw(d DrawStyle) Series {
+	s.Draw = d
+	return s
+}
+
+func (s Series) WithColour(c string) Series {
+	s.Colour = c
+	return s
+}
+
+func (s Series) WithNegative(field string) Series {
+	s.Negative = field
+	return s
+}
+
+func (s Series) WithoutGraph() Series {
+	s.NoGraph = true
+	return s
+}
+
+func (s Series) WithCDef(cdef string) Series {
+	s.CDef = cdef
+	return s
+}
+
+func (s Series) WithExtInfo(info string) Series {
+	s.ExtInfo = info
+	return s
+}
+
+func (s Series) WithSum(fields ...string) Series {
+	s.Sum = fields
+	return s
+}
+
+// Validate that the Series settings make sense together.
+// Returns Problems if there are any.
+func (s Series) Validate() error {
+	if ps := s.problems(""); len(ps) != 0 {
+		return ps
+	}
+	return nil
+}
+
+func (s Series) problems(field string) (ps Problems) {
+	add := func(warning bool, format string, a ...interface{}) {
+		ps = append(ps, Problem{Field: field, Message: fmt.Sprintf(format, a...), Warning: warning})
+	}
+
+	if s.Label == "" {
+		add(false, "label is empty")
+	} else if len(s.Label) > MaxLabelLength {
+		add(true, "label is %d characters long, keep it under %d to fit the graph legend", len(s.Label), MaxLabelLength)
+	}
+	for _, attr := range [][2]string{{"label", s.Label}, {"info", s.Info}, {"extinfo", s.ExtInfo}, {"cdef", s.CDef}} {
+		if strings.ContainsAny(attr[1], "\r\n") {
+			add(false, "%s contains a newline", attr[0])
+		}
+	}
+
+	switch s.Type {
+	case Default, Gauge:
+	case Counter, Derive, Absolute:
+		// Rates computed by Munin can go negative when a counter is reset,
+		// so a min is needed to discard those spikes.
+		if s.Type != Counter && math.IsNaN(s.Min) {
+			add(false, "%s series must set a min, usually 0", s.Type)
+		}
+		if s.Type != Derive && s.Min < 0 {
+			add(false, "%s series cannot have a negative min", s.Type)
+		}
+	default:
+		add(false, "unknown type %d", int(s.Type))
+	}
+
+	if s.Min > s.Max {
+		add(false, "min %v is above max %v", s.Min, s.Max)
+	}
+	if s.WarnMin > s.Warn {
+		add(false, "warning range %v:%v has min above max", s.WarnMin, s.Warn)
+	}
+	if s.CritMin > s.Crit {
+		add(false, "critical range %v:%v has min above max", s.CritMin, s.Crit)
+	}
+	if s.Warn > s.Crit {
+		add(false, "warning %v is above critical %v", s.Warn, s.Crit)
+	}
+	if s.WarnMin < s.CritMin {
+		add(false, "warning min %v is below critical min %v", s.WarnMin, s.CritMin)
+	}
+
+	if !s.Draw.valid() {
+		add(false, "unknown draw style %q", s.Draw)
+	}
+	if s.Colour != "" && !colour.MatchString(s.Colour) {
+		add(false, "colour %q is not a hex RRGGBB value", s.Colour)
+	}
+
+	return
+}
+
 // Config values for a single Munin graph/plugin.
 type Config struct {
 	// Title of the graph.
@@ -135,17 +357,233 @@ type Config struct {
 	// so that 1M represents 1048576 instead of 1000000, etc.
 	Base int
 
+	// LowerLimit of the y-axis. Use WithLimits to set.
+	LowerLimit *float64
+
+	// UpperLimit of the y-axis. Use WithLimits to set.
+	UpperLimit *float64
+
+	// Logarithmic y-axis instead of linear.
+	Logarithmic bool
+
+	// Rigid limits which are not expanded to fit values outside of them.
+	Rigid bool
+
+	// ExtraArgs passed on to rrdtool graph after those set by the fields above,
+	// e.g. "--units-exponent", "3".
+	ExtraArgs []string
+
+	// NoScale disables SI prefix scaling of values in the graph legend.
+	NoScale bool
+
+	// Period for rates of Counter, Derive and Absolute series, e.g. "minute". Munin defaults to "second".
+	Period string
+
+	// Total adds a line with the sum of all series, with this label.
+	Total string
+
+	// Width of the graph in pixels.
+	Width int
+
+	// Height of the graph in pixels.
+	Height int
+
+	// Printf format for values in the graph legend, e.g. "%6.2lf".
+	Printf string
+
+	// NoGraph hides the graph while still recording its values.
+	NoGraph bool
+
+	// UpdateRate in seconds, if the plugin should be polled more often than every 5 minutes.
+	UpdateRate int
+
+	// DataSize of the RRD files, e.g. "normal", "huge" or "custom 1d, 1m for 1w".
+	DataSize string
+
+	// Order in which series are drawn, by field name.
+	// Series not listed are drawn after these in alphabetical order.
+	Order []string
+
 	// Series which should be displayed on the graph, keyed by their internal field name.
 	// These keys will be sanitized to meet Munin requirements.
 	Series map[string]Series
 }
 
+// WithLimits on the y-axis. Either side may be NaN to leave it unset.
+func (c Config) WithLimits(lower, upper float64) Config {
+	c.LowerLimit = nil
+	c.UpperLimit = nil
+	if !math.IsNaN(lower) {
+		c.LowerLimit = &lower
+	}
+	if !math.IsNaN(upper) {
+		c.UpperLimit = &upper
+	}
+	return c
+}
+
+// WithOrder of series by field name.
+func (c Config) WithOrder(fields ...string) Config {
+	c.Order = fields
+	return c
+}
+
+// Validate the Config, reporting every Problem found.
+// Returns Problems, including warnings, if there are any.
+func (c Config) Validate() error {
+	if ps := c.problems(); len(ps) != 0 {
+		return ps
+	}
+	return nil
+}
+
+func (c Config) problems() (ps Problems) {
+	add := func(field string, warning bool, format string, a ...interface{}) {
+		ps = append(ps, Problem{Field: field, Message: fmt.Sprintf(format, a...), Warning: warning})
+	}
+
+	if c.Title == "" {
+		add("", false, "title is empty")
+	}
+	for _, attr := range [][2]string{
+		{"title", c.Title},
+		{"category", c.Category},
+		{"info", c.Info},
+		{"vlabel", c.YAxis},
+		{"total", c.Total},
+		{"printf", c.Printf},
+	} {
+		if strings.ContainsAny(attr[1], "\r\n") {
+			add("", false, "%s contains a newline", attr[0])
+		}
+	}
+
+	switch c.Period {
+	case "", "second", "minute", "hour":
+	default:
+		add("", false, "period %q should be second, minute or hour", c.Period)
+	}
+	if c.Width < 0 || c.Height < 0 {
+		add("", false, "size %dx%d cannot be negative", c.Width, c.Height)
+	}
+	if c.UpdateRate < 0 {
+		add("", false, "update rate %d cannot be negative", c.UpdateRate)
+	}
+	if c.LowerLimit != nil && c.UpperLimit != nil && *c.LowerLimit > *c.UpperLimit {
+		add("", false, "lower limit %v is above upper limit %v", *c.LowerLimit, *c.UpperLimit)
+	}
+	if c.Logarithmic && c.LowerLimit != nil && *c.LowerLimit <= 0 {
+		add("", false, "logarithmic graph needs a positive lower limit")
+	}
+
+	for _, key := range c.Order {
+		if _, ok := c.Series[key]; !ok {
+			add("", false, "ordered series %q does not exist", key)
+		}
+	}
+
+	fields := make(map[string][]string)
+	for _, key := range c.seriesKeys() {
+		field := CleanFieldName(key)
+		fields[field] = append(fields[field], key)
+
+		series := c.Series[key]
+		ps = append(ps, series.problems(key)...)
+
+		if series.Negative != "" {
+			if series.Negative == key {
+				add(key, false, "series cannot be its own negative")
+			} else if _, ok := c.Series[series.Negative]; !ok {
+				add(key, false, "negative series %q does not exist", series.Negative)
+			}
+		}
+
+		for _, sum := range series.Sum {
+			if i := strings.LastIndex(sum, "."); i >= 0 {
+				if i == 0 || i == len(sum)-1 {
+					add(key, false, "summed series %q should be plugin.field", sum)
+				}
+			} else if _, ok := c.Series[sum]; !ok {
+				add(key, false, "summed series %q does not exist", sum)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		if keys := fields[field]; len(keys) > 1 {
+			add(field, false, "series %s all have the same field name", strings.Join(keys, ", "))
+		}
+		if reservedFieldName(field) {
+			add(field, false, "field name is reserved by Munin")
+		}
+	}
+
+	return
+}
+
+func reservedFieldName(field string) bool {
+	switch field {
+	case "graph", "multigraph", "host_name", "update", "update_rate":
+		return true
+	default:
+		return strings.HasPrefix(field, "graph_")
+	}
+}
+
+// seriesKeys in Order, followed by the rest in alphabetical order.
+func (c Config) seriesKeys() []string {
+	keys := make([]string, 0, len(c.Series))
+	ordered := make(map[string]bool)
+	for _, key := range c.Order {
+		if _, ok := c.Series[key]; ok && !ordered[key] {
+			keys = append(keys, key)
+			ordered[key] = true
+		}
+	}
+
+	rest := make([]string, 0, len(c.Series)-len(keys))
+	for key := range c.Series {
+		if !ordered[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(keys, rest...)
+}
+
+func (c Config) graphArgs() string {
+	var args []string
+	if c.Base != 0 {
+		args = append(args, "--base "+strconv.Itoa(c.Base))
+	}
+	if c.LowerLimit != nil {
+		args = append(args, "--lower-limit "+strconv.FormatFloat(*c.LowerLimit, 'f', -1, 64))
+	}
+	if c.UpperLimit != nil {
+		args = append(args, "--upper-limit "+strconv.FormatFloat(*c.UpperLimit, 'f', -1, 64))
+	}
+	if c.Logarithmic {
+		args = append(args, "--logarithmic")
+	}
+	if c.Rigid {
+		args = append(args, "--rigid")
+	}
+	args = append(args, c.ExtraArgs...)
+	return strings.Join(args, " ")
+}
+
 func (c Config) String() string {
 	buf := new(bytes.Buffer)
 
 	fmt.Fprintf(buf, "graph_title %s\n", c.Title)
-	if c.Base != 0 {
-		fmt.Fprintf(buf, "graph_args --base %d\n", c.Base)
+	if args := c.graphArgs(); args != "" {
+		fmt.Fprintf(buf, "graph_args %s\n", args)
 	}
 	if c.Category != "" {
 		fmt.Fprintf(buf, "graph_category %s\n", c.Category)
@@ -156,40 +594,111 @@ func (c Config) String() string {
 	if c.Info != "" {
 		fmt.Fprintf(buf, "graph_info %s\n", c.Info)
 	}
-
-	keys := make([]string, len(c.Series))
-	var i int
-	for key := range c.Series {
-		keys[i] = key
-		i++
+	if c.NoScale {
+		fmt.Fprint(buf, "graph_scale no\n")
+	}
+	if c.Period != "" {
+		fmt.Fprintf(buf, "graph_period %s\n", c.Period)
+	}
+	if c.Total != "" {
+		fmt.Fprintf(buf, "graph_total %s\n", c.Total)
+	}
+	if c.Width != 0 {
+		fmt.Fprintf(buf, "graph_width %d\n", c.Width)
+	}
+	if c.Height != 0 {
+		fmt.Fprintf(buf, "graph_height %d\n", c.Height)
+	}
+	if c.Printf != "" {
+		fmt.Fprintf(buf, "graph_printf %s\n", c.Printf)
+	}
+	if c.NoGraph {
+		fmt.Fprint(buf, "graph no\n")
+	}
+	if c.UpdateRate != 0 {
+		fmt.Fprintf(buf, "update_rate %d\n", c.UpdateRate)
+	}
+	if c.DataSize != "" {
+		fmt.Fprintf(buf, "graph_data_size %s\n", c.DataSize)
+	}
+	if len(c.Order) != 0 {
+		fields := make([]string, len(c.Order))
+		for i, field := range c.Order {
+			fields[i] = CleanFieldName(field)
+		}
+		fmt.Fprintf(buf, "graph_order %s\n", strings.Join(fields, " "))
 	}
-	sort.Strings(keys)
 
-	for _, key := range keys {
+	for _, key := range c.seriesKeys() {
 		series := c.Series[key]
-		key = cleanFieldName(key)
+		key = CleanFieldName(key)
 		if series.Label != "" {
 			fmt.Fprintf(buf, "%s.label %s\n", key, series.Label)
 		}
 		if series.Type != Default {
 			fmt.Fprintf(buf, "%s.type %s\n", key, series.Type)
 		}
+		if series.Draw != "" {
+			fmt.Fprintf(buf, "%s.draw %s\n", key, series.Draw)
+		}
+		if series.Colour != "" {
+			fmt.Fprintf(buf, "%s.colour %s\n", key, series.Colour)
+		}
 		if !math.IsNaN(series.Min) {
 			fmt.Fprintf(buf, "%s.min %f\n", key, series.Min)
 		}
 		if !math.IsNaN(series.Max) {
 			fmt.Fprintf(buf, "%s.max %f\n", key, series.Max)
 		}
-		if !math.IsNaN(series.Warn) {
-			fmt.Fprintf(buf, "%s.warn %f\n", key, series.Warn)
+		if !math.IsNaN(series.WarnMin) || !math.IsNaN(series.Warn) {
+			fmt.Fprintf(buf, "%s.warning %s\n", key, formatRange(series.WarnMin, series.Warn))
+		}
+		if !math.IsNaN(series.CritMin) || !math.IsNaN(series.Crit) {
+			fmt.Fprintf(buf, "%s.critical %s\n", key, formatRange(series.CritMin, series.Crit))
 		}
-		if !math.IsNaN(series.Crit) {
-			fmt.Fprintf(buf, "%s.crit %f\n", key, series.Crit)
+		if series.NoGraph {
+			fmt.Fprintf(buf, "%s.graph no\n", key)
+		}
+		if series.Negative != "" {
+			fmt.Fprintf(buf, "%s.negative %s\n", key, CleanFieldName(series.Negative))
+		}
+		if series.CDef != "" {
+			fmt.Fprintf(buf, "%s.cdef %s\n", key, series.CDef)
+		}
+		if len(series.Sum) != 0 {
+			fields := make([]string, len(series.Sum))
+			for i, field := range series.Sum {
+				fields[i] = cleanSumField(field)
+			}
+			fmt.Fprintf(buf, "%s.sum %s\n", key, strings.Join(fields, " "))
 		}
 		if series.Info != "" {
 			fmt.Fprintf(buf, "%s.info %s\n", key, series.Info)
 		}
+		if series.ExtInfo != "" {
+			fmt.Fprintf(buf, "%s.extinfo %s\n", key, series.ExtInfo)
+		}
 	}
 
 	return buf.String()
 }
+
+// formatRange of a warning or critical threshold as min:max, just the max if there is no min.
+func formatRange(min, max float64) string {
+	if math.IsNaN(min) {
+		return fmt.Sprintf("%f", max)
+	}
+	var hi string
+	if !math.IsNaN(max) {
+		hi = fmt.Sprintf("%f", max)
+	}
+	return fmt.Sprintf("%f", min) + ":" + hi
+}
+
+// cleanSumField cleans a field name in Series.Sum, keeping the dot of a "plugin.field" reference.
+func cleanSumField(field string) string {
+	if i := strings.LastIndex(field, "."); i >= 0 {
+		return CleanGraphName(field[:i]) + "." + CleanFieldName(field[i+1:])
+	}
+	return CleanFieldName(field)
+}
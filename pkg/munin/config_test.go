@@ -0,0 +1,216 @@
+package munin
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConfigString(t *testing.T) {
+	tests := []struct {
+		name   string
+		series Series
+		want   string
+	}{
+		{
+			"default",
+			NewSeries("data"),
+			"graph_title Test\nx.label data\n",
+		},
+		{
+			"gauge",
+			NewSeries("data").WithType(Gauge),
+			"graph_title Test\nx.label data\nx.type GAUGE\n",
+		},
+		{
+			"counter",
+			NewSeries("data").WithType(Counter),
+			"graph_title Test\nx.label data\nx.type COUNTER\n",
+		},
+		{
+			"derive",
+			NewSeries("data").WithType(Derive).WithRange(0, math.NaN()),
+			"graph_title Test\nx.label data\nx.type DERIVE\nx.min 0.000000\n",
+		},
+		{
+			"absolute",
+			NewSeries("data").WithType(Absolute).WithRange(0, 100),
+			"graph_title Test\nx.label data\nx.type ABSOLUTE\nx.min 0.000000\nx.max 100.000000\n",
+		},
+		{
+			"warnings",
+			NewSeries("data").WithWarnings(80, 90),
+			"graph_title Test\nx.label data\nx.warning 80.000000\nx.critical 90.000000\n",
+		},
+		{
+			"other plugin sum",
+			NewSeries("data").WithSum("if_eth0.down", "if_eth1.down"),
+			"graph_title Test\nx.label data\nx.sum if_eth0.down if_eth1.down\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := Config{Title: "Test", Series: map[string]Series{"x": tt.series}}
+			if got := conf.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphType(t *testing.T) {
+	for _, want := range []GraphType{Default, Gauge, Counter, Derive, Absolute} {
+		got, err := ParseGraphType(want.String())
+		if err != nil {
+			t.Errorf("ParseGraphType(%q) error = %v", want, err)
+		} else if got != want {
+			t.Errorf("ParseGraphType(%q) = %v, want %v", want, got, want)
+		}
+	}
+
+	if _, err := ParseGraphType("RATE"); err == nil {
+		t.Errorf("ParseGraphType(%q) error = nil, want error", "RATE")
+	}
+}
+
+func TestSeriesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		series  Series
+		wantErr bool
+	}{
+		{"gauge", NewSeries("data").WithType(Gauge), false},
+		{"gauge negative", NewSeries("data").WithType(Gauge).WithRange(-10, 10), false},
+		{"counter", NewSeries("data").WithType(Counter), false},
+		{"counter negative", NewSeries("data").WithType(Counter).WithRange(-1, math.NaN()), true},
+		{"derive", NewSeries("data").WithType(Derive).WithRange(0, math.NaN()), false},
+		{"derive negative", NewSeries("data").WithType(Derive).WithRange(-100, math.NaN()), false},
+		{"derive without min", NewSeries("data").WithType(Derive), true},
+		{"absolute", NewSeries("data").WithType(Absolute).WithRange(0, math.NaN()), false},
+		{"absolute without min", NewSeries("data").WithType(Absolute), true},
+		{"absolute negative", NewSeries("data").WithType(Absolute).WithRange(-1, math.NaN()), true},
+		{"unknown type", NewSeries("data").WithType(GraphType(42)), true},
+		{"min above max", NewSeries("data").WithRange(10, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.series.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigStringAttributes(t *testing.T) {
+	conf := Config{
+		Title: "Traffic",
+		Series: map[string]Series{
+			"down": NewSeries("received").
+				WithType(Derive).
+				WithRange(0, math.NaN()).
+				WithoutGraph(),
+			"up": NewSeries("bps").
+				WithType(Derive).
+				WithRange(0, math.NaN()).
+				WithDraw(AreaStack).
+				WithColour("00CC00").
+				WithNegative("down").
+				WithCDef("up,8,*").
+				WithWarningRange(10, math.NaN()).
+				WithCriticalRange(1, 1000).
+				WithExtInfo("check the link"),
+			"total": NewSeries("total").WithSum("up", "down"),
+		},
+	}
+
+	want := "graph_title Traffic\n" +
+		"down.label received\n" +
+		"down.type DERIVE\n" +
+		"down.min 0.000000\n" +
+		"down.graph no\n" +
+		"total.label total\n" +
+		"total.sum up down\n" +
+		"up.label bps\n" +
+		"up.type DERIVE\n" +
+		"up.draw AREASTACK\n" +
+		"up.colour 00CC00\n" +
+		"up.min 0.000000\n" +
+		"up.warning 10.000000:\n" +
+		"up.critical 1.000000:1000.000000\n" +
+		"up.negative down\n" +
+		"up.cdef up,8,*\n" +
+		"up.extinfo check the link\n"
+	if got := conf.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		series  map[string]Series
+		wantErr bool
+	}{
+		{"empty", nil, false},
+		{"unknown draw", map[string]Series{"a": NewSeries("a").WithDraw("PIE")}, true},
+		{"bad colour", map[string]Series{"a": NewSeries("a").WithColour("green")}, true},
+		{"own negative", map[string]Series{"a": NewSeries("a").WithNegative("a")}, true},
+		{"missing negative", map[string]Series{"a": NewSeries("a").WithNegative("b")}, true},
+		{"missing sum", map[string]Series{"a": NewSeries("a").WithSum("b")}, true},
+		{"other plugin sum", map[string]Series{"a": NewSeries("a").WithSum("if_eth0.down")}, false},
+		{"incomplete plugin sum", map[string]Series{"a": NewSeries("a").WithSum("if_eth0.")}, true},
+		{"inverted warning", map[string]Series{"a": NewSeries("a").WithWarningRange(10, 1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := Config{Title: "Test", Series: tt.series}
+			if err := conf.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigStringGraphOptions(t *testing.T) {
+	conf := Config{
+		Title:       "Load",
+		Base:        1000,
+		Logarithmic: true,
+		Rigid:       true,
+		ExtraArgs:   []string{"--units-exponent", "0"},
+		NoScale:     true,
+		Period:      "minute",
+		Total:       "All",
+		Width:       800,
+		Height:      200,
+		Printf:      "%6.2lf",
+		UpdateRate:  60,
+		DataSize:    "huge",
+		Series: map[string]Series{
+			"a": NewSeries("a"),
+			"b": NewSeries("b"),
+			"c": NewSeries("c"),
+		},
+	}.WithLimits(0, math.NaN()).WithOrder("c", "a")
+
+	want := "graph_title Load\n" +
+		"graph_args --base 1000 --lower-limit 0 --logarithmic --rigid --units-exponent 0\n" +
+		"graph_scale no\n" +
+		"graph_period minute\n" +
+		"graph_total All\n" +
+		"graph_width 800\n" +
+		"graph_height 200\n" +
+		"graph_printf %6.2lf\n" +
+		"update_rate 60\n" +
+		"graph_data_size huge\n" +
+		"graph_order c a\n" +
+		"c.label c\n" +
+		"a.label a\n" +
+		"b.label b\n"
+	if got := conf.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
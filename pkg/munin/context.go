@@ -0,0 +1,205 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout for a plugin run if env.timeout is not set.
+// This is a little under the munin-node default of 10 seconds,
+// so the plugin has a chance to report why it ran out of time.
+const DefaultTimeout = 8 * time.Second
+
+// A ContextPlugin is cancelled when it runs out of time or the plugin is interrupted.
+// Run uses ConfigContext and FetchContext instead of Config and Fetch if a Plugin implements them.
+type ContextPlugin interface {
+	Plugin
+
+	ConfigContext(ctx context.Context, env Env) (conf Config, err error)
+	FetchContext(ctx context.Context, env Env) (values Values, precision Precision, err error)
+}
+
+// A ContextMultigraphPlugin is the MultigraphPlugin equivalent of a ContextPlugin.
+// Run uses GraphsContext and FetchGraphsContext instead of Graphs and FetchGraphs if a MultigraphPlugin implements them.
+type ContextMultigraphPlugin interface {
+	MultigraphPlugin
+
+	GraphsContext(ctx context.Context, env Env) (confs map[string]Config, err error)
+	FetchGraphsContext(ctx context.Context, env Env) (values map[string]Values, precision map[string]Precision, err error)
+}
+
+// A ContextSampleFetcher is the SampleFetcher equivalent of a ContextPlugin.
+// Run uses FetchSamplesContext instead of FetchSamples or Fetch if a Plugin implements it.
+// A plain SampleFetcher cannot be cancelled, and is left running when time runs out.
+type ContextSampleFetcher interface {
+	FetchSamplesContext(ctx context.Context, env Env) (samples Samples, precision Precision, err error)
+}
+
+// A ContextGraphSampleFetcher is the GraphSampleFetcher equivalent of a ContextMultigraphPlugin.
+// Run uses FetchGraphSamplesContext instead of FetchGraphSamples or FetchGraphs if a MultigraphPlugin implements it.
+type ContextGraphSampleFetcher interface {
+	FetchGraphSamplesContext(ctx context.Context, env Env) (samples map[string]Samples, precision map[string]Precision, err error)
+}
+
+// runContext for a plugin run, which is cancelled after env.timeout or on SIGTERM or SIGINT.
+func (r *Runner) runContext(e Env) (ctx context.Context, cancel context.CancelFunc) {
+	timeout := DefaultTimeout
+	if text := e["timeout"]; text != "" {
+		if t, err := parseTimeout(text); err == nil {
+			timeout = t
+		} else {
+			r.warnf("invalid env.timeout %q, using %v", text, timeout)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	cancel = func() {
+		cancelTimeout()
+		stop()
+	}
+	return
+}
+
+// parseTimeout as either a number of seconds, like munin-node, or a duration such as "1m30s".
+func parseTimeout(text string) (timeout time.Duration, err error) {
+	if secs, perr := strconv.ParseFloat(text, 64); perr == nil {
+		timeout = time.Duration(secs * float64(time.Second))
+	} else if timeout, err = time.ParseDuration(text); err != nil {
+		return
+	}
+
+	if timeout <= 0 {
+		err = fmt.Errorf("timeout must be positive")
+	}
+	return
+}
+
+// A result of a plugin method, sent back from the goroutine which called it.
+// Each field is only set by the method it belongs to.
+type result struct {
+	conf  Config
+	confs map[string]Config
+
+	samples      Samples
+	precision    Precision
+	graphSamples map[string]Samples
+	graphPrec    map[string]Precision
+
+	err error
+}
+
+// call fn and wait for it to return, unless ctx is done first.
+// This means plugins which ignore the context are still stopped in time.
+// fn runs in its own goroutine, which may outlive call, so it must only return its result
+// rather than write to variables shared with the caller.
+func call(ctx context.Context, fn func() result) result {
+	done := make(chan result, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case res := <-done:
+		return res
+	case <-ctx.Done():
+		return result{err: ctx.Err()}
+	}
+}
+
+func loadConfig(ctx context.Context, p Plugin, e Env) (Config, error) {
+	res := call(ctx, func() (res result) {
+		if cp, ok := p.(ContextPlugin); ok {
+			res.conf, res.err = cp.ConfigContext(ctx, e)
+		} else {
+			res.conf, res.err = p.Config(e)
+		}
+		return
+	})
+	return res.conf, res.err
+}
+
+func loadGraphs(ctx context.Context, p MultigraphPlugin, e Env) (map[string]Config, error) {
+	res := call(ctx, func() (res result) {
+		if cp, ok := p.(ContextMultigraphPlugin); ok {
+			res.confs, res.err = cp.GraphsContext(ctx, e)
+		} else {
+			res.confs, res.err = p.Graphs(e)
+		}
+		return
+	})
+	return res.confs, res.err
+}
+
+func fetchSamples(ctx context.Context, p Plugin, e Env) (Samples, Precision, error) {
+	res := call(ctx, func() (res result) {
+		if sf, ok := p.(ContextSampleFetcher); ok {
+			res.samples, res.precision, res.err = sf.FetchSamplesContext(ctx, e)
+			return
+		}
+		if sf, ok := p.(SampleFetcher); ok {
+			res.samples, res.precision, res.err = sf.FetchSamples(e)
+			return
+		}
+
+		var values Values
+		if cp, ok := p.(ContextPlugin); ok {
+			values, res.precision, res.err = cp.FetchContext(ctx, e)
+		} else {
+			values, res.precision, res.err = p.Fetch(e)
+		}
+		res.samples = values.Samples()
+		return
+	})
+	return res.samples, res.precision, res.err
+}
+
+func fetchGraphSamples(ctx context.Context, p MultigraphPlugin, e Env) (map[string]Samples, map[string]Precision, error) {
+	res := call(ctx, func() (res result) {
+		if sf, ok := p.(ContextGraphSampleFetcher); ok {
+			res.graphSamples, res.graphPrec, res.err = sf.FetchGraphSamplesContext(ctx, e)
+			return
+		}
+		if sf, ok := p.(GraphSampleFetcher); ok {
+			res.graphSamples, res.graphPrec, res.err = sf.FetchGraphSamples(e)
+			return
+		}
+
+		var values map[string]Values
+		if cp, ok := p.(ContextMultigraphPlugin); ok {
+			values, res.graphPrec, res.err = cp.FetchGraphsContext(ctx, e)
+		} else {
+			values, res.graphPrec, res.err = p.FetchGraphs(e)
+		}
+		res.graphSamples = make(map[string]Samples, len(values))
+		for name, v := range values {
+			res.graphSamples[name] = v.Samples()
+		}
+		return
+	})
+	return res.graphSamples, res.graphPrec, res.err
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// JSONVersion of the schema written by the "json" command.
+// It changes only when fields are removed or change meaning; new fields may be added at any time.
+const JSONVersion = 1
+
+// JSONOutput is the schema of the "json" command, which prints the configuration
+// and current values of every graph as a single JSON document for scripts and dashboards.
+//
+// Optional attributes which are not set are omitted. Unlike the Munin protocol,
+// field names are the keys used by the Plugin, before they are made safe for Munin.
+type JSONOutput struct {
+	// Version of the schema, JSONVersion.
+	Version int `json:"version"`
+
+	// Plugin name the plugin was invoked as.
+	Plugin string `json:"plugin"`
+
+	// Graphs sorted by name. A plugin which is not a MultigraphPlugin has a single graph
+	// named after the plugin.
+	Graphs []JSONGraph `json:"graphs"`
+}
+
+// JSONGraph is a graph and its fields in JSONOutput, with the attributes of a Config.
+type JSONGraph struct {
+	Name        string   `json:"name"`
+	Title       string   `json:"title"`
+	Category    string   `json:"category,omitempty"`
+	Info        string   `json:"info,omitempty"`
+	YAxis       string   `json:"vlabel,omitempty"`
+	Base        int      `json:"base,omitempty"`
+	LowerLimit  *float64 `json:"lower_limit,omitempty"`
+	UpperLimit  *float64 `json:"upper_limit,omitempty"`
+	Logarithmic bool     `json:"logarithmic,omitempty"`
+	Rigid       bool     `json:"rigid,omitempty"`
+	ExtraArgs   []string `json:"extra_args,omitempty"`
+	NoScale     bool     `json:"no_scale,omitempty"`
+	Period      string   `json:"period,omitempty"`
+	Total       string   `json:"total,omitempty"`
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	Printf      string   `json:"printf,omitempty"`
+	NoGraph     bool     `json:"no_graph,omitempty"`
+	UpdateRate  int      `json:"update_rate,omitempty"`
+	DataSize    string   `json:"data_size,omitempty"`
+
+	// Fields in graph order. Fields which were fetched but not configured come last.
+	Fields []JSONField `json:"fields"`
+}
+
+// JSONField is a field and its values in JSONOutput, with the attributes of a Series.
+type JSONField struct {
+	Name     string     `json:"name"`
+	Label    string     `json:"label"`
+	Info     string     `json:"info,omitempty"`
+	Type     GraphType  `json:"type,omitempty"`
+	Min      *float64   `json:"min,omitempty"`
+	Max      *float64   `json:"max,omitempty"`
+	Warning  *JSONRange `json:"warning,omitempty"`
+	Critical *JSONRange `json:"critical,omitempty"`
+	Draw     DrawStyle  `json:"draw,omitempty"`
+	Colour   string     `json:"colour,omitempty"`
+	Negative string     `json:"negative,omitempty"`
+	NoGraph  bool       `json:"no_graph,omitempty"`
+	CDef     string     `json:"cdef,omitempty"`
+	ExtInfo  string     `json:"extinfo,omitempty"`
+	Sum      []string   `json:"sum,omitempty"`
+
+	// Precision values are formatted with in the Munin protocol.
+	Precision int `json:"precision"`
+
+	// Values fetched for the field, oldest first. Always has at least one value,
+	// which is unknown if the plugin did not return one.
+	Values []JSONValue `json:"values"`
+}
+
+// JSONRange of a warning or critical threshold, with either side optional.
+type JSONRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// JSONValue is a single value of a field in JSONOutput.
+type JSONValue struct {
+	// Value is null if it is unknown.
+	Value *float64 `json:"value"`
+
+	// Unknown is true if the plugin could not get the value, as reported to Munin with U.
+	Unknown bool `json:"unknown"`
+
+	// Time the value was collected, omitted if it was collected at the time of the fetch.
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// optional float, nil if it is NaN.
+func optional(f float64) *float64 {
+	if math.IsNaN(f) {
+		return nil
+	}
+	return &f
+}
+
+func jsonRange(min, max float64) *JSONRange {
+	if math.IsNaN(min) && math.IsNaN(max) {
+		return nil
+	}
+	return &JSONRange{Min: optional(min), Max: optional(max)}
+}
+
+func jsonGraph(name string, conf Config, samples Samples, precision Precision) JSONGraph {
+	g := JSONGraph{
+		Name:        name,
+		Title:       conf.Title,
+		Category:    conf.Category,
+		Info:        conf.Info,
+		YAxis:       conf.YAxis,
+		Base:        conf.Base,
+		LowerLimit:  conf.LowerLimit,
+		UpperLimit:  conf.UpperLimit,
+		Logarithmic: conf.Logarithmic,
+		Rigid:       conf.Rigid,
+		ExtraArgs:   conf.ExtraArgs,
+		NoScale:     conf.NoScale,
+		Period:      conf.Period,
+		Total:       conf.Total,
+		Width:       conf.Width,
+		Height:      conf.Height,
+		Printf:      conf.Printf,
+		NoGraph:     conf.NoGraph,
+		UpdateRate:  conf.UpdateRate,
+		DataSize:    conf.DataSize,
+		Fields:      make([]JSONField, 0, len(samples)),
+	}
+
+	keys := conf.seriesKeys()
+	var extra []string
+	for key := range samples {
+		if _, ok := conf.Series[key]; !ok {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+
+	for _, key := range append(keys, extra...) {
+		f := JSONField{Name: key, Precision: precision[key]}
+		if s, ok := conf.Series[key]; ok {
+			f.Label = s.Label
+			f.Info = s.Info
+			f.Type = s.Type
+			f.Min = optional(s.Min)
+			f.Max = optional(s.Max)
+			f.Warning = jsonRange(s.WarnMin, s.Warn)
+			f.Critical = jsonRange(s.CritMin, s.Crit)
+			f.Draw = s.Draw
+			f.Colour = s.Colour
+			f.Negative = s.Negative
+			f.NoGraph = s.NoGraph
+			f.CDef = s.CDef
+			f.ExtInfo = s.ExtInfo
+			f.Sum = s.Sum
+		}
+
+		for _, sample := range samples[key] {
+			var v JSONValue
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				v.Unknown = true
+			} else {
+				v.Value = optional(sample.Value)
+			}
+			if !sample.Time.IsZero() {
+				t := sample.Time.UTC()
+				v.Time = &t
+			}
+			f.Values = append(f.Values, v)
+		}
+		g.Fields = append(g.Fields, f)
+	}
+	return g
+}
+
+// emitJSON prints the configuration and values of every graph as JSONOutput.
+func (r *Runner) emitJSON(ctx context.Context, p Plugin, e Env) int {
+	var confs map[string]Config
+	var samples map[string]Samples
+	var precision map[string]Precision
+	var err error
+
+	if mp, ok := p.(MultigraphPlugin); ok {
+		if confs, err = loadGraphs(ctx, mp, e); err != nil {
+			return r.fail(ctx, err)
+		}
+		samples, precision, err = fetchGraphSamples(ctx, mp, e)
+	} else {
+		var conf Config
+		if conf, err = loadConfig(ctx, p, e); err != nil {
+			return r.fail(ctx, err)
+		}
+		confs = map[string]Config{r.name: conf}
+
+		var s Samples
+		var pr Precision
+		s, pr, err = fetchSamples(ctx, p, e)
+		samples = map[string]Samples{r.name: s}
+		precision = map[string]Precision{r.name: pr}
+	}
+	if err != nil {
+		keep, code, ok := r.recoverFetch(ctx, err)
+		if !ok {
+			return code
+		}
+		if !keep {
+			samples = nil
+		}
+	}
+
+	all := make(map[string]Config, len(confs)+len(samples))
+	for name := range samples {
+		all[name] = Config{}
+	}
+	for name, conf := range confs {
+		all[name] = conf
+	}
+
+	out := JSONOutput{Version: JSONVersion, Plugin: r.name, Graphs: make([]JSONGraph, 0, len(all))}
+	for _, name := range graphNames(all) {
+		out.Graphs = append(out.Graphs, jsonGraph(name, all[name], samples[name].withUnknowns(all[name]), precision[name]))
+	}
+
+	enc := json.NewEncoder(r.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return r.fail(ctx, err)
+	}
+	return 0
+}
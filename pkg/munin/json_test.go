@@ -0,0 +1,129 @@
+package munin
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testSamplePlugin struct {
+	testPlugin
+}
+
+func (p *testSamplePlugin) FetchSamples(env Env) (samples Samples, precision Precision, err error) {
+	samples = Samples{
+		"a": {{Value: 1.5, Time: time.Unix(1600000000, 0)}, {Value: 2.5, Time: time.Unix(1600000300, 0)}},
+		"c": {{Value: 3}},
+	}
+	precision = Precision{"a": 1}
+	return
+}
+
+func TestRunJSON(t *testing.T) {
+	one, two, onePointFive, twoPointFive, three := 1.0, 2.0, 1.5, 2.5, 3.0
+	t1, t2 := time.Unix(1600000000, 0).UTC(), time.Unix(1600000300, 0).UTC()
+	unknown := []JSONValue{{Unknown: true}}
+
+	tests := []struct {
+		name   string
+		plugin Plugin
+		args   []string
+		env    Env
+		want   JSONOutput
+	}{
+		{
+			"plugin",
+			new(testPlugin),
+			[]string{"test_x", "json"},
+			nil,
+			JSONOutput{Version: JSONVersion, Plugin: "test_x", Graphs: []JSONGraph{{
+				Name:  "test_x",
+				Title: "Test x",
+				Fields: []JSONField{
+					{Name: "a", Label: "a", Type: Gauge, Values: []JSONValue{{Value: &one}}},
+					{Name: "b", Label: "b", Type: Gauge, Values: unknown},
+				},
+			}}},
+		},
+		{
+			"format flag",
+			new(testPlugin),
+			[]string{"test", "--format=json"},
+			nil,
+			JSONOutput{Version: JSONVersion, Plugin: "test", Graphs: []JSONGraph{{
+				Name:  "test",
+				Title: "Test ",
+				Fields: []JSONField{
+					{Name: "a", Label: "a", Type: Gauge, Values: []JSONValue{{Value: &one}}},
+					{Name: "b", Label: "b", Type: Gauge, Values: unknown},
+				},
+			}}},
+		},
+		{
+			"samples",
+			new(testSamplePlugin),
+			[]string{"test", "json"},
+			nil,
+			JSONOutput{Version: JSONVersion, Plugin: "test", Graphs: []JSONGraph{{
+				Name:  "test",
+				Title: "Test ",
+				Fields: []JSONField{
+					{Name: "a", Label: "a", Type: Gauge, Precision: 1, Values: []JSONValue{{Value: &onePointFive, Time: &t1}, {Value: &twoPointFive, Time: &t2}}},
+					{Name: "b", Label: "b", Type: Gauge, Values: unknown},
+					{Name: "c", Values: []JSONValue{{Value: &three}}},
+				},
+			}}},
+		},
+		{
+			"multigraph",
+			new(testMultigraphPlugin),
+			[]string{"test", "json"},
+			nil,
+			JSONOutput{Version: JSONVersion, Plugin: "test", Graphs: []JSONGraph{
+				{
+					Name:  "test",
+					Title: "Test ",
+					Fields: []JSONField{
+						{Name: "a", Label: "a", Type: Gauge, Values: []JSONValue{{Value: &one}}},
+						{Name: "b", Label: "b", Type: Gauge, Values: []JSONValue{{Value: &two}}},
+					},
+				},
+				{Name: "test.more", Title: "More", Fields: []JSONField{}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+			code := RunWith(tt.plugin, WithArgs(tt.args...), WithEnv(tt.env), WithStdout(stdout), WithStderr(stderr))
+			if code != 0 {
+				t.Fatalf("RunWith() = %d, stderr %q", code, stderr)
+			}
+
+			var got JSONOutput
+			if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RunWith() = %s", stdout)
+			}
+		})
+	}
+}
+
+func TestJSONRange(t *testing.T) {
+	conf := Config{Title: "t", Series: map[string]Series{
+		"a": NewSeries("a").WithWarnings(10, 20).WithCriticalRange(5, 20),
+	}}
+	got, err := json.Marshal(jsonGraph("g", conf, Samples{"a": {{Value: 1}}}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"name":"g","title":"t","fields":[{"name":"a","label":"a","warning":{"max":10},"critical":{"min":5,"max":20},"precision":0,"values":[{"value":1,"unknown":false}]}]}`
+	if string(got) != want {
+		t.Errorf("json = %s, want %s", got, want)
+	}
+}
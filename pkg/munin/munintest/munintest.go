@@ -0,0 +1,212 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package munintest runs munin plugins in tests and compares their output with golden files.
+//
+// Golden files live in the testdata directory of the package under test.
+// Run the tests with -update to write them from the current output.
+package munintest
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/quells/munin/internal/set"
+	"github.com/quells/munin/pkg/munin"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// DefaultName of a plugin under test, unless env sets munin.PluginEnv.
+const DefaultName = "plugin"
+
+// Output of a plugin run.
+type Output struct {
+	Code   int
+	Stdout string
+	Stderr string
+}
+
+// Run the plugin with env and args, like munin-node would.
+// The plugin is invoked as env[munin.PluginEnv], or DefaultName if that is not set.
+func Run(t testing.TB, p munin.Plugin, env munin.Env, args ...string) (out Output) {
+	t.Helper()
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	out.Code = munin.RunWith(p,
+		munin.WithArgs(append([]string{pluginName(env)}, args...)...),
+		munin.WithEnv(env),
+		munin.WithStdout(stdout),
+		munin.WithStderr(stderr),
+	)
+	out.Stdout = stdout.String()
+	out.Stderr = stderr.String()
+	return
+}
+
+// Config output of the plugin. Fails the test if the plugin exits with an error.
+func Config(t testing.TB, p munin.Plugin, env munin.Env) string {
+	t.Helper()
+	return mustRun(t, p, env, "config")
+}
+
+// Fetch output of the plugin. Fails the test if the plugin exits with an error.
+func Fetch(t testing.TB, p munin.Plugin, env munin.Env) string {
+	t.Helper()
+	return mustRun(t, p, env)
+}
+
+// DirtyConfig output of the plugin, with configuration and values in one run.
+// Fails the test if the plugin exits with an error.
+func DirtyConfig(t testing.TB, p munin.Plugin, env munin.Env) string {
+	t.Helper()
+	return mustRun(t, p, with(env, "MUNIN_CAP_DIRTYCONFIG", "1"), "config")
+}
+
+// AutoConf output of the plugin. Fails the test if the plugin exits with an error.
+func AutoConf(t testing.TB, p munin.Plugin, env munin.Env) string {
+	t.Helper()
+	return mustRun(t, p, env, "autoconf")
+}
+
+// Golden compares got with testdata/name.golden, or updates the file with -update.
+func Golden(t testing.TB, name string, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s does not match golden file %s\ngot:\n%s\nwant:\n%s", name, path, got, want)
+	}
+}
+
+// FieldsMatch checks that the plugin fetches a value for every field in its configuration, and no others.
+// Fetch output can't be used for this, since Run reports configured fields which are left out as unknown,
+// so the fields come from calling the plugin's fetch method directly. Values set to unknown still count.
+func FieldsMatch(t testing.TB, p munin.Plugin, env munin.Env) {
+	t.Helper()
+
+	config := Fields(Config(t, p, env))
+	fetch, err := FetchedFields(p, env)
+	if err != nil {
+		t.Fatalf("fetching fields: %v", err)
+	}
+	if !reflect.DeepEqual(config, fetch) {
+		t.Errorf("config fields %v do not match fetch fields %v", config, fetch)
+	}
+}
+
+// FetchedFields returns the fields the plugin fetches values for, sorted and named like Fields,
+// without those Run would add as unknown from its configuration.
+// The plugin is fetched by munin.Runner.Fetch, so multigraph plugins are fetched as multigraphs
+// if env sets MUNIN_CAP_MULTIGRAPH.
+func FetchedFields(p munin.Plugin, env munin.Env) ([]string, error) {
+	samples, err := munin.NewRunner(munin.WithArgs(pluginName(env)), munin.WithEnv(env)).Fetch(p)
+	if !valuesKept(err) {
+		return nil, err
+	}
+
+	fields := make(set.Strings)
+	for graph, s := range samples {
+		for key := range s {
+			if graph == "" {
+				fields[munin.CleanFieldName(key)] = struct{}{}
+			} else {
+				fields[munin.CleanGraphName(graph)+"/"+munin.CleanFieldName(key)] = struct{}{}
+			}
+		}
+	}
+	return fields.Sorted(), nil
+}
+
+// Fields named in config or fetch output, sorted.
+// Fields of multigraph plugins are prefixed with their graph name and a slash.
+func Fields(output string) []string {
+	fields := make(set.Strings)
+
+	var graph string
+	for _, line := range strings.Split(output, "\n") {
+		key := strings.SplitN(line, " ", 2)[0]
+		if key == "multigraph" {
+			graph = strings.TrimPrefix(line, "multigraph ") + "/"
+			continue
+		}
+
+		if i := strings.Index(key, "."); i > 0 {
+			fields[graph+key[:i]] = struct{}{}
+		}
+	}
+
+	return fields.Sorted()
+}
+
+func mustRun(t testing.TB, p munin.Plugin, env munin.Env, args ...string) string {
+	t.Helper()
+
+	out := Run(t, p, env, args...)
+	if out.Code != 0 {
+		t.Fatalf("plugin %v exited with %d: %s", args, out.Code, out.Stderr)
+	}
+	return out.Stdout
+}
+
+// pluginName the plugin is invoked as, env[munin.PluginEnv] or DefaultName.
+func pluginName(env munin.Env) string {
+	if name := env[munin.PluginEnv]; name != "" {
+		return name
+	}
+	return DefaultName
+}
+
+// valuesKept is true if err is nil or a munin.PartialError, where Run still emits the values.
+func valuesKept(err error) bool {
+	var pe *munin.PartialError
+	return err == nil || errors.As(err, &pe)
+}
+
+// with a copy of env with key set to value.
+func with(env munin.Env, key, value string) munin.Env {
+	e := make(munin.Env, len(env)+1)
+	for k, v := range env {
+		e[k] = v
+	}
+	e[key] = value
+	return e
+}
@@ -0,0 +1,164 @@
+package munintest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+type plugin struct {
+	values munin.Values
+	err    error
+}
+
+func (p *plugin) Help() string {
+	return "Test plugin"
+}
+
+func (p *plugin) Config(env munin.Env) (conf munin.Config, err error) {
+	conf.Title = "Test " + env.Wildcard()
+	conf.Series = map[string]munin.Series{
+		"a":   munin.NewSeries("a"),
+		"b.c": munin.NewSeries("b.c"),
+	}
+	return
+}
+
+func (p *plugin) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	return p.values, nil, p.err
+}
+
+func (p *plugin) WildcardPrefix() string {
+	return "test_"
+}
+
+type multigraphPlugin struct {
+	plugin
+	values map[string]munin.Values
+}
+
+func (p *multigraphPlugin) Graphs(env munin.Env) (confs map[string]munin.Config, err error) {
+	conf, err := p.Config(env)
+	confs = map[string]munin.Config{"test": conf, "test.more": {Title: "More", Series: map[string]munin.Series{"d": munin.NewSeries("d")}}}
+	return
+}
+
+func (p *multigraphPlugin) FetchGraphs(env munin.Env) (values map[string]munin.Values, precision map[string]munin.Precision, err error) {
+	return p.values, nil, nil
+}
+
+// recorder is a testing.TB which records failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, a ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, a...))
+}
+
+func (r *recorder) Fatalf(format string, a ...interface{}) {
+	r.Errorf(format, a...)
+	runtime.Goexit()
+}
+
+// record the failures of fn, which may stop early with Fatalf.
+func record(t *testing.T, fn func(t testing.TB)) []string {
+	r := &recorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(r)
+	}()
+	<-done
+	return r.failures
+}
+
+func TestFields(t *testing.T) {
+	output := "multigraph test\n" +
+		"graph_title Test\n" +
+		"a.label a\n" +
+		"a.type GAUGE\n" +
+		"multigraph test.more\n" +
+		"d.value 1\n"
+	if got, want := Fields(output), []string{"test.more/d", "test/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %v, want %v", got, want)
+	}
+}
+
+func TestFieldsMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		plugin munin.Plugin
+		env    munin.Env
+		fails  bool
+	}{
+		{"all fields", &plugin{values: munin.Values{"a": 1, "b.c": 2}}, nil, false},
+		{"unknown field", &plugin{values: munin.Values{"a": 1, "b.c": math.NaN()}}, nil, false},
+		{"missing field", &plugin{values: munin.Values{"a": 1}}, nil, true},
+		{"extra field", &plugin{values: munin.Values{"a": 1, "b.c": 2, "e": 3}}, nil, true},
+		{"partial error", &plugin{values: munin.Values{"a": 1, "b.c": 2}, err: &munin.PartialError{Err: errors.New("partial")}}, nil, false},
+		{"transient error", &plugin{err: &munin.TransientError{Err: errors.New("down")}}, nil, true},
+		{
+			"multigraph",
+			&multigraphPlugin{values: map[string]munin.Values{"test": {"a": 1, "b.c": 2}, "test.more": {"d": 3}}},
+			munin.Env{"MUNIN_CAP_MULTIGRAPH": "1"},
+			false,
+		},
+		{
+			"multigraph missing graph",
+			&multigraphPlugin{values: map[string]munin.Values{"test": {"a": 1, "b.c": 2}}},
+			munin.Env{"MUNIN_CAP_MULTIGRAPH": "1"},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := record(t, func(t testing.TB) {
+				FieldsMatch(t, tt.plugin, tt.env)
+			})
+			if fails := len(failures) != 0; fails != tt.fails {
+				t.Errorf("FieldsMatch() failures %q, want failure %v", failures, tt.fails)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	out := Run(t, &plugin{values: munin.Values{"a": 1}}, munin.Env{munin.PluginEnv: "test_x"}, "config")
+	want := Output{Stdout: "graph_title Test x\na.label a\nb_c.label b.c\n"}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("Run() = %+v, want %+v", out, want)
+	}
+}
+
+func TestFetchFails(t *testing.T) {
+	failures := record(t, func(t testing.TB) {
+		Fetch(t, &plugin{err: &munin.ConfigError{Err: errors.New("env.host is not set")}}, nil)
+	})
+	want := []string{"plugin [] exited with 1: plugin: configuration: env.host is not set\n"}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("Fetch() failures = %q, want %q", failures, want)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	if *update {
+		t.Skip("testdata/golden.golden is not written by this test")
+	}
+	Golden(t, "golden", "a.value 1\n")
+
+	failures := record(t, func(t testing.TB) {
+		Golden(t, "golden", "a.value 2\n")
+	})
+	if len(failures) != 1 {
+		t.Errorf("Golden() failures = %q, want a mismatch", failures)
+	}
+}
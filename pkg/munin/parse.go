@@ -0,0 +1,338 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseConfig from plugin config output, the inverse of Config.String.
+// Returns each graph keyed by name, from multigraph lines.
+// Lines before any multigraph line belong to the graph named "".
+// Values included with the dirtyconfig capability are ignored.
+func ParseConfig(r io.Reader) (confs map[string]Config, err error) {
+	confs = make(map[string]Config)
+
+	var graph string
+	conf := newConfig()
+	flush := func() {
+		if conf.Title != "" || len(conf.Series) != 0 {
+			confs[graph] = conf
+		}
+	}
+
+	err = scanLines(r, func(key, value string) error {
+		if key == "multigraph" {
+			flush()
+			graph = value
+			conf = newConfig()
+			return nil
+		}
+		return setConfig(&conf, key, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+
+	return
+}
+
+// ParseValues from plugin fetch output.
+// Returns values and their precision for each graph keyed by name, from multigraph lines.
+// Lines before any multigraph line belong to the graph named "".
+// Unknown values are NaN. If a field has several timestamped values, the last one is used.
+func ParseValues(r io.Reader) (values map[string]Values, precision map[string]Precision, err error) {
+	samples, precision, err := ParseSamples(r)
+	if err != nil {
+		return
+	}
+
+	values = make(map[string]Values, len(samples))
+	for graph, s := range samples {
+		values[graph] = make(Values, len(s))
+		for field, fieldSamples := range s {
+			values[graph][field] = fieldSamples[len(fieldSamples)-1].Value
+		}
+	}
+	return
+}
+
+// ParseSamples from plugin fetch output, like ParseValues but keeping every timestamped value.
+func ParseSamples(r io.Reader) (samples map[string]Samples, precision map[string]Precision, err error) {
+	samples = make(map[string]Samples)
+	precision = make(map[string]Precision)
+
+	var graph string
+	err = scanLines(r, func(key, value string) error {
+		if key == "multigraph" {
+			graph = value
+			return nil
+		}
+
+		field := strings.TrimSuffix(key, ".value")
+		if field == key {
+			// config output with the dirtyconfig capability
+			return nil
+		}
+
+		sample, digits, err := parseSample(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+
+		if samples[graph] == nil {
+			samples[graph] = make(Samples)
+			precision[graph] = make(Precision)
+		}
+		samples[graph][field] = append(samples[graph][field], sample)
+		if p, ok := precision[graph][field]; !ok || digits > p {
+			precision[graph][field] = digits
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+// scanLines of plugin output, calling fn with the key and value of each line
+// that is not blank or a comment.
+func scanLines(r io.Reader, fn func(key, value string) error) error {
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+		key, value := splitLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// splitLine into key and value, skipping blank lines and comments.
+func splitLine(line string) (key, value string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	parts := strings.SplitN(line, " ", 2)
+	key = parts[0]
+	if len(parts) == 2 {
+		value = strings.TrimSpace(parts[1])
+	}
+	return
+}
+
+// parseSample from fetch output, which may be U for unknown or prefixed with an epoch timestamp.
+// Also returns the number of digits after the decimal point.
+func parseSample(text string) (sample Sample, digits int, err error) {
+	if i := strings.Index(text, ":"); i >= 0 {
+		var epoch int64
+		if epoch, err = strconv.ParseInt(text[:i], 10, 64); err != nil {
+			return
+		}
+		sample.Time = time.Unix(epoch, 0)
+		text = text[i+1:]
+	}
+
+	if text == "U" {
+		sample.Value = math.NaN()
+		return
+	}
+
+	if i := strings.Index(text, "."); i >= 0 {
+		digits = len(text) - i - 1
+	}
+	sample.Value, err = strconv.ParseFloat(text, 64)
+	return
+}
+
+func newConfig() Config {
+	return Config{Series: make(map[string]Series)}
+}
+
+// setConfig attribute from a line of config output.
+// Unrecognized attributes are ignored, as they are by Munin.
+func setConfig(conf *Config, key, value string) (err error) {
+	if i := strings.Index(key, "."); i > 0 {
+		field, attr := key[:i], key[i+1:]
+		if attr == "value" {
+			// values included in config output with the dirtyconfig capability
+			return
+		}
+
+		series, ok := conf.Series[field]
+		if !ok {
+			series = NewSeries("")
+		}
+		if err = setSeries(&series, attr, value); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		conf.Series[field] = series
+		return
+	}
+
+	switch key {
+	case "graph_title":
+		conf.Title = value
+	case "graph_category":
+		conf.Category = value
+	case "graph_info":
+		conf.Info = value
+	case "graph_vlabel":
+		conf.YAxis = value
+	case "graph_args":
+		err = setGraphArgs(conf, value)
+	case "graph_scale":
+		conf.NoScale = value == "no"
+	case "graph_period":
+		conf.Period = value
+	case "graph_total":
+		conf.Total = value
+	case "graph_width":
+		conf.Width, err = strconv.Atoi(value)
+	case "graph_height":
+		conf.Height, err = strconv.Atoi(value)
+	case "graph_printf":
+		conf.Printf = value
+	case "graph":
+		conf.NoGraph = value == "no"
+	case "update_rate":
+		conf.UpdateRate, err = strconv.Atoi(value)
+	case "graph_data_size":
+		conf.DataSize = value
+	case "graph_order":
+		conf.Order = strings.Fields(value)
+	}
+	return
+}
+
+func setGraphArgs(conf *Config, value string) (err error) {
+	args := strings.Fields(value)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// param of the flag, either --flag=param or --flag param
+		param := func() string {
+			if j := strings.Index(arg, "="); j >= 0 {
+				return arg[j+1:]
+			}
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		float := func() (x *float64, err error) {
+			f, err := strconv.ParseFloat(param(), 64)
+			return &f, err
+		}
+
+		switch strings.SplitN(arg, "=", 2)[0] {
+		case "--base":
+			conf.Base, err = strconv.Atoi(param())
+		case "--lower-limit", "-l":
+			conf.LowerLimit, err = float()
+		case "--upper-limit", "-u":
+			conf.UpperLimit, err = float()
+		case "--logarithmic", "-o":
+			conf.Logarithmic = true
+		case "--rigid", "-r":
+			conf.Rigid = true
+		default:
+			// Anything else, including the params of unknown flags, is kept in order.
+			conf.ExtraArgs = append(conf.ExtraArgs, arg)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func setSeries(s *Series, attr, value string) (err error) {
+	switch attr {
+	case "label":
+		s.Label = value
+	case "info":
+		s.Info = value
+	case "type":
+		s.Type, err = ParseGraphType(value)
+	case "min":
+		s.Min, err = strconv.ParseFloat(value, 64)
+	case "max":
+		s.Max, err = strconv.ParseFloat(value, 64)
+	case "warn", "warning":
+		s.WarnMin, s.Warn, err = parseRange(value)
+	case "crit", "critical":
+		s.CritMin, s.Crit, err = parseRange(value)
+	case "draw":
+		s.Draw = DrawStyle(value)
+	case "colour":
+		s.Colour = value
+	case "negative":
+		s.Negative = value
+	case "graph":
+		s.NoGraph = value == "no"
+	case "cdef":
+		s.CDef = value
+	case "extinfo":
+		s.ExtInfo = value
+	case "sum":
+		s.Sum = strings.Fields(value)
+	}
+	return
+}
+
+// parseRange of a warning or critical threshold, either max or min:max with either side optional.
+func parseRange(text string) (min, max float64, err error) {
+	min, max = math.NaN(), math.NaN()
+
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) == 1 {
+		max, err = strconv.ParseFloat(text, 64)
+		return
+	}
+
+	if parts[0] != "" {
+		if min, err = strconv.ParseFloat(parts[0], 64); err != nil {
+			return
+		}
+	}
+	if parts[1] != "" {
+		max, err = strconv.ParseFloat(parts[1], 64)
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package munin
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// randomConfig with every option set at random, using values which survive formatting.
+func randomConfig(r *rand.Rand) (conf Config) {
+	maybe := func(text string) string {
+		if r.Intn(2) == 0 {
+			return ""
+		}
+		return text
+	}
+	number := func() float64 {
+		if r.Intn(3) == 0 {
+			return math.NaN()
+		}
+		return float64(r.Intn(2000)-1000) / 4
+	}
+
+	conf.Title = fmt.Sprintf("Graph %d", r.Intn(100))
+	conf.Category = maybe("testing")
+	conf.Info = maybe("Some information.")
+	conf.YAxis = maybe("things per ${graph_period}")
+	conf.Base = []int{0, 1000, 1024}[r.Intn(3)]
+	conf.Logarithmic = r.Intn(2) == 0
+	conf.Rigid = r.Intn(2) == 0
+	if r.Intn(3) == 0 {
+		conf.ExtraArgs = []string{"--units-exponent", "3"}
+	}
+	conf.NoScale = r.Intn(2) == 0
+	conf.Period = maybe("minute")
+	conf.Total = maybe("Total")
+	conf.Width = r.Intn(2) * 400
+	conf.Height = r.Intn(2) * 200
+	conf.Printf = maybe("%6.2lf")
+	conf.NoGraph = r.Intn(4) == 0
+	conf.UpdateRate = r.Intn(2) * 60
+	conf.DataSize = maybe("custom 1d, 1m for 1w")
+	conf = conf.WithLimits(number(), number())
+
+	types := []GraphType{Default, Gauge, Counter, Derive, Absolute}
+	draws := []DrawStyle{"", Line1, Line2, Area, Stack, AreaStack, LineStack1}
+
+	conf.Series = make(map[string]Series)
+	n := r.Intn(5)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("field_%d", i)
+		s := NewSeries(fmt.Sprintf("Field %d", i)).
+			WithInfo(maybe("Information about the field.")).
+			WithType(types[r.Intn(len(types))]).
+			WithRange(number(), number()).
+			WithWarningRange(number(), number()).
+			WithCriticalRange(number(), number()).
+			WithDraw(draws[r.Intn(len(draws))]).
+			WithColour(maybe("00CC00")).
+			WithCDef(maybe(key + ",8,*")).
+			WithExtInfo(maybe("More information."))
+		if r.Intn(4) == 0 {
+			s = s.WithoutGraph()
+		}
+		if i > 0 && r.Intn(3) == 0 {
+			s = s.WithNegative("field_0")
+		}
+		if i > 1 && r.Intn(3) == 0 {
+			s = s.WithSum("field_0", "field_1")
+		}
+		conf.Series[key] = s
+	}
+	if n > 1 && r.Intn(2) == 0 {
+		conf.Order = []string{fmt.Sprintf("field_%d", n-1), "field_0"}
+	}
+
+	return
+}
+
+func TestParseConfigRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		conf := randomConfig(r)
+		text := conf.String()
+
+		confs, err := ParseConfig(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("ParseConfig(%q) error = %v", text, err)
+		}
+		if got := confs[""].String(); got != text {
+			t.Fatalf("ParseConfig(%q).String() = %q", text, got)
+		}
+	}
+}
+
+func TestParseConfigMultigraph(t *testing.T) {
+	text := "multigraph a\n" +
+		"graph_title A\n" +
+		"graph_args --base 1000 -l 0 --upper-limit=100 --units-exponent 3\n" +
+		"x.label x\n" +
+		"x.warning 1:\n" +
+		"x.critical :10\n" +
+		"x.value 3\n" +
+		"# a comment\n" +
+		"multigraph a.b\n" +
+		"graph_title B\n"
+
+	confs, err := ParseConfig(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lower, upper := 0.0, 100.0
+	x := NewSeries("x").WithWarningRange(1, math.NaN()).WithCriticalRange(math.NaN(), 10)
+	want := map[string]Config{
+		"a": {
+			Title:      "A",
+			Base:       1000,
+			LowerLimit: &lower,
+			UpperLimit: &upper,
+			ExtraArgs:  []string{"--units-exponent", "3"},
+			Series:     map[string]Series{"x": x},
+		},
+		"a.b": {Title: "B", Series: map[string]Series{}},
+	}
+	if got := fmt.Sprint(confs); got != fmt.Sprint(want) {
+		t.Errorf("ParseConfig() = %v, want %v", got, want)
+	}
+}
+
+func TestParseSamplesRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		samples := make(Samples)
+		precision := make(Precision)
+		for j := 0; j < r.Intn(5); j++ {
+			key := fmt.Sprintf("field_%d", j)
+			precision[key] = r.Intn(4)
+			for k := 0; k <= r.Intn(3); k++ {
+				var s Sample
+				if r.Intn(5) == 0 {
+					s.Value = math.NaN()
+				} else {
+					s.Value = math.Round(r.NormFloat64()*1e4) / math.Pow10(precision[key])
+				}
+				if r.Intn(2) == 0 {
+					s.Time = time.Unix(1600000000+int64(k)*300, 0)
+				}
+				samples[key] = append(samples[key], s)
+			}
+		}
+
+		buf := new(bytes.Buffer)
+		writeSamples(buf, samples, precision)
+		text := buf.String()
+
+		parsed, _, err := ParseSamples(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("ParseSamples(%q) error = %v", text, err)
+		}
+
+		got := new(bytes.Buffer)
+		writeSamples(got, parsed[""], precision)
+		if got.String() != text {
+			t.Fatalf("ParseSamples(%q) = %q", text, got)
+		}
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	text := "a.value 1\n" +
+		"b.value U\n" +
+		"multigraph more\n" +
+		"c.value 1600000000:1.25\n" +
+		"c.value 1600000300:2.5\n"
+
+	values, precision, err := ParseValues(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := values[""]["b"]; !math.IsNaN(b) {
+		t.Errorf("b = %v, want NaN", b)
+	}
+	delete(values[""], "b")
+
+	wantValues := map[string]Values{"": {"a": 1}, "more": {"c": 2.5}}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("ParseValues() values = %v, want %v", values, wantValues)
+	}
+	wantPrecision := map[string]Precision{"": {"a": 0, "b": 0}, "more": {"c": 2}}
+	if !reflect.DeepEqual(precision, wantPrecision) {
+		t.Errorf("ParseValues() precision = %v, want %v", precision, wantPrecision)
+	}
+
+	if _, _, err := ParseValues(strings.NewReader("a.value many")); err == nil {
+		t.Error("ParseValues(invalid) error = nil, want error")
+	}
+}
@@ -22,23 +22,83 @@ package munin
 
 import (
 	"bytes"
-	"fmt"
 	"math"
-	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
-
-	"github.com/quells/munin/internal/env"
+	"strings"
+	"time"
 )
 
 // Env variables passed in to the plugin.
 type Env map[string]string
 
+const (
+	// PluginEnv is set by Run to the name the plugin was invoked as.
+	PluginEnv = "MUNIN_PLUGIN"
+
+	// WildcardEnv is set by Run to the suffix after the prefix of a WildcardPlugin,
+	// e.g. "eth0" for a plugin with prefix "if_" symlinked as "if_eth0".
+	WildcardEnv = "MUNIN_WILDCARD"
+)
+
+// Plugin name the plugin was invoked as.
+func (e Env) Plugin() string {
+	return e[PluginEnv]
+}
+
+// Wildcard suffix of the plugin name, or empty if the plugin was not invoked as a wildcard plugin.
+func (e Env) Wildcard() string {
+	return e[WildcardEnv]
+}
+
 // Values produced by the plugin.
 // Keyed by the field name of the corresponding Series.
+// NaN and infinite values are reported to Munin as unknown.
 type Values map[string]float64
 
+// SetUnknown reports the value for a field as unknown, leaving a gap in the graph.
+func (v Values) SetUnknown(key string) {
+	v[key] = math.NaN()
+}
+
+// Samples of the current values, without timestamps.
+func (v Values) Samples() Samples {
+	samples := make(Samples, len(v))
+	for key, value := range v {
+		samples[key] = []Sample{{Value: value}}
+	}
+	return samples
+}
+
+// A Sample is a value with an optional timestamp.
+// Timestamps allow values collected between runs of the plugin to be backfilled.
+type Sample struct {
+	Value float64
+
+	// Time the value was collected. Munin uses the time of the fetch if this is zero.
+	Time time.Time
+}
+
+// Samples produced by the plugin, oldest first.
+// Keyed by the field name of the corresponding Series.
+type Samples map[string][]Sample
+
+// withUnknowns adds an unknown value for each Series in conf that is missing from samples.
+func (s Samples) withUnknowns(conf Config) Samples {
+	all := make(Samples, len(conf.Series))
+	for key := range conf.Series {
+		all[key] = []Sample{{Value: math.NaN()}}
+	}
+	for key, samples := range s {
+		if len(samples) != 0 {
+			all[key] = samples
+		}
+	}
+	return all
+}
+
 // Precision (number of digits after the decimal place) for values produced by the plugin.
 // Keyed by the field name of the corresponding Series.
 type Precision map[string]int
@@ -61,45 +121,71 @@ type Plugin interface {
 	Fetch(env Env) (values Values, precision Precision, err error)
 }
 
-// Run the Plugin as a good Munin citizen.
-// Supports the "dirty config" capability for one-shot configuration and value emission.
-func Run(p Plugin) {
-	if helpRequested() {
-		help := p.Help()
-		fmt.Fprintf(os.Stdout, "%s\n", help)
-		os.Exit(0)
-	}
+// A MultigraphPlugin produces several graphs from a single invocation, keyed by graph name.
+// Graph names may use dots to nest graphs, e.g. "pihole" and "pihole.queries".
+//
+// Config and Fetch are still used when the Munin node does not advertise the multigraph
+// capability, so they should describe the most important graph on its own.
+type MultigraphPlugin interface {
+	Plugin
 
-	e := env.Parse(os.Environ())
+	// Graphs returns configuration data for each graph, keyed by graph name.
+	Graphs(env Env) (confs map[string]Config, err error)
 
-	if len(os.Args) == 2 && os.Args[1] == "config" {
-		emitConfig(p, e)
-		if e["MUNIN_CAP_DIRTYCONFIG"] == "1" {
-			emitValues(p, e)
-		}
-		os.Exit(0)
-	}
+	// FetchGraphs returns data values for each graph, keyed by graph name.
+	FetchGraphs(env Env) (values map[string]Values, precision map[string]Precision, err error)
+}
 
-	emitValues(p, e)
-	os.Exit(0)
+// A SampleFetcher can return several timestamped samples per field, e.g. from a spool of
+// readings taken between polls. Run uses FetchSamples instead of Fetch if a Plugin implements it.
+type SampleFetcher interface {
+	FetchSamples(env Env) (samples Samples, precision Precision, err error)
 }
 
-func helpRequested() bool {
-	if len(os.Args) == 2 {
-		switch os.Args[1] {
-		case "help":
-			return true
-		case "--help":
-			return true
-		case "-h":
-			return true
-		}
-	}
+// A GraphSampleFetcher is the MultigraphPlugin equivalent of a SampleFetcher.
+// Run uses FetchGraphSamples instead of FetchGraphs if a MultigraphPlugin implements it.
+type GraphSampleFetcher interface {
+	FetchGraphSamples(env Env) (samples map[string]Samples, precision map[string]Precision, err error)
+}
+
+// An AutoConfigurer reports whether a plugin can run on this node.
+// Plugins which implement it answer the "autoconf" command used by munin-node-configure.
+type AutoConfigurer interface {
+	// AutoConf returns true if the plugin should be enabled,
+	// otherwise false and a short reason why not.
+	AutoConf(env Env) (ok bool, reason string)
+}
 
-	return false
+// A Suggester lists the wildcard suffixes a plugin can be linked as on this node.
+// Plugins which implement it answer the "suggest" command used by munin-node-configure.
+type Suggester interface {
+	// Suggest returns wildcard suffixes, e.g. "eth0" and "eth1" for an "if_" plugin.
+	Suggest(env Env) (suggestions []string, err error)
 }
 
-func formatValue(value float64, precision int) string {
+// A WildcardPlugin can be linked under several names, each ending in a different suffix,
+// e.g. "if_eth0" and "if_eth1" for an "if_" plugin. Run only sets Env.Wildcard for plugins
+// which implement it, so an underscore in the name of any other plugin is not mistaken for one.
+type WildcardPlugin interface {
+	// WildcardPrefix returns the part of the plugin name before the suffix, e.g. "if_".
+	WildcardPrefix() string
+}
+
+// parsePluginName from the path the plugin was invoked as,
+// splitting off the wildcard suffix after prefix, if the plugin declares one.
+func parsePluginName(arg0, prefix string) (name, wildcard string) {
+	name = filepath.Base(arg0)
+	if prefix != "" && strings.HasPrefix(name, prefix) {
+		wildcard = name[len(prefix):]
+	}
+	return
+}
+
+// FormatValue as Run writes it, rounded to precision decimal places, or "U" if it is NaN or infinite.
+func FormatValue(value float64, precision int) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "U"
+	}
 	if precision == 0 {
 		return strconv.Itoa(int(math.Round(value)))
 	}
@@ -108,7 +194,11 @@ func formatValue(value float64, precision int) string {
 
 var fieldName = regexp.MustCompile(`(^[^A-Za-z_]|[^A-Za-z0-9_])`)
 
-func cleanFieldName(text string) string {
+// CleanFieldName makes text safe to use as a field name, replacing characters Munin does not allow
+// with underscores, as Run does for the keys of Values and Series.
+// Plugins which build field names from outside data, like API responses, can use it to
+// know the names Munin will see. The result is stable, but different texts may clean to the same name.
+func CleanFieldName(text string) string {
 	if text == "root" {
 		return "_root"
 	}
@@ -116,39 +206,54 @@ func cleanFieldName(text string) string {
 	return fieldName.ReplaceAllString(text, "_")
 }
 
-func emitConfig(p Plugin, e Env) {
-	conf, err := p.Config(e)
-	if err != nil {
-		fmt.Fprint(os.Stderr, err.Error())
-		os.Exit(1)
-	}
+var graphName = regexp.MustCompile(`(^[^A-Za-z_]|[^A-Za-z0-9_.])`)
 
-	fmt.Fprintf(os.Stdout, "%s", conf)
+// CleanGraphName is like CleanFieldName but keeps dots, which separate nested multigraphs.
+// Run uses it for the graph names of a MultigraphPlugin.
+func CleanGraphName(text string) string {
+	return graphName.ReplaceAllString(text, "_")
 }
 
-func emitValues(p Plugin, e Env) {
-	values, precision, err := p.Fetch(e)
-	if err != nil {
-		fmt.Fprint(os.Stderr, err.Error())
-		os.Exit(1)
+func isTrue(text string) bool {
+	switch strings.ToLower(text) {
+	case "1", "yes", "true", "on":
+		return true
+	default:
+		return false
 	}
+}
 
-	keys := make([]string, len(values))
+func graphNames(confs map[string]Config) []string {
+	names := make([]string, len(confs))
 	var i int
-	for k := range values {
+	for name := range confs {
+		names[i] = name
+		i++
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeSamples(buf *bytes.Buffer, samples Samples, precision Precision) {
+	keys := make([]string, len(samples))
+	var i int
+	for k := range samples {
 		keys[i] = k
 		i++
 	}
 	sort.Strings(keys)
 
-	buf := new(bytes.Buffer)
 	for _, k := range keys {
-		v := values[k]
 		p := precision[k]
-		buf.WriteString(cleanFieldName(k))
-		buf.WriteString(".value ")
-		buf.WriteString(formatValue(v, p))
-		buf.WriteByte('\n')
+		for _, sample := range samples[k] {
+			buf.WriteString(CleanFieldName(k))
+			buf.WriteString(".value ")
+			if !sample.Time.IsZero() {
+				buf.WriteString(strconv.FormatInt(sample.Time.Unix(), 10))
+				buf.WriteByte(':')
+			}
+			buf.WriteString(FormatValue(sample.Value, p))
+			buf.WriteByte('\n')
+		}
 	}
-	fmt.Fprint(os.Stdout, buf.String())
 }
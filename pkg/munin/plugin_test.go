@@ -0,0 +1,79 @@
+package munin
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value     float64
+		precision int
+		want      string
+	}{
+		{1.4, 0, "1"},
+		{1.5, 0, "2"},
+		{0.1234, 2, "0.12"},
+		{math.NaN(), 0, "U"},
+		{math.Inf(1), 2, "U"},
+		{math.Inf(-1), 0, "U"},
+	}
+	for _, tt := range tests {
+		if got := FormatValue(tt.value, tt.precision); got != tt.want {
+			t.Errorf("FormatValue(%v, %d) = %q, want %q", tt.value, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestParsePluginName(t *testing.T) {
+	tests := []struct {
+		arg0, prefix   string
+		name, wildcard string
+	}{
+		{"/etc/munin/plugins/if_eth0", "if_", "if_eth0", "eth0"},
+		{"if_", "if_", "if_", ""},
+		{"cpu_usage", "", "cpu_usage", ""},
+		{"cpu_usage", "if_", "cpu_usage", ""},
+		{"pihole_pi.hole", "pihole_", "pihole_pi.hole", "pi.hole"},
+	}
+	for _, tt := range tests {
+		name, wildcard := parsePluginName(tt.arg0, tt.prefix)
+		if name != tt.name || wildcard != tt.wildcard {
+			t.Errorf("parsePluginName(%q, %q) = %q, %q, want %q, %q", tt.arg0, tt.prefix, name, wildcard, tt.name, tt.wildcard)
+		}
+	}
+}
+
+func TestSamplesWithUnknowns(t *testing.T) {
+	conf := Config{Series: map[string]Series{"a": NewSeries("a"), "b": NewSeries("b")}}
+	samples := Values{"a": 1, "c": 3}.Samples().withUnknowns(conf)
+
+	if b := samples["b"]; len(b) != 1 || !math.IsNaN(b[0].Value) {
+		t.Errorf("samples[b] = %v, want NaN", b)
+	}
+	delete(samples, "b")
+	if want := (Samples{"a": {{Value: 1}}, "c": {{Value: 3}}}); !reflect.DeepEqual(samples, want) {
+		t.Errorf("withUnknowns() = %v, want %v", samples, want)
+	}
+}
+
+func TestWriteSamples(t *testing.T) {
+	samples := Samples{
+		"a": {{Value: 1}},
+		"b": {
+			{Value: 1.5, Time: time.Unix(1600000000, 0)},
+			{Value: math.NaN(), Time: time.Unix(1600000300, 0)},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	writeSamples(buf, samples, Precision{"b": 1})
+
+	want := "a.value 1\nb.value 1600000000:1.5\nb.value 1600000300:U\n"
+	if got := buf.String(); got != want {
+		t.Errorf("writeSamples() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/quells/munin/internal/env"
+)
+
+// A Runner runs a Plugin with the given arguments, environment and output streams.
+// Run uses the values from the os package, while tests can inject their own with RunWith.
+type Runner struct {
+	// Args the plugin was invoked with, including the plugin name like os.Args.
+	Args []string
+
+	// Env variables passed in to the plugin.
+	Env Env
+
+	// Stdout receives configuration and values.
+	Stdout io.Writer
+
+	// Stderr receives error messages.
+	Stderr io.Writer
+
+	// name of the plugin, prefixed to error messages.
+	name string
+}
+
+// An Option changes how a Runner runs a Plugin.
+type Option func(r *Runner)
+
+// WithArgs the plugin is invoked with, including the plugin name like os.Args.
+func WithArgs(args ...string) Option {
+	return func(r *Runner) {
+		r.Args = args
+	}
+}
+
+// WithEnv variables passed in to the plugin instead of the process environment.
+func WithEnv(e Env) Option {
+	return func(r *Runner) {
+		r.Env = e
+	}
+}
+
+func WithStdout(w io.Writer) Option {
+	return func(r *Runner) {
+		r.Stdout = w
+	}
+}
+
+func WithStderr(w io.Writer) Option {
+	return func(r *Runner) {
+		r.Stderr = w
+	}
+}
+
+// NewRunner using the process arguments, environment and output streams unless overridden by opts.
+func NewRunner(opts ...Option) *Runner {
+	r := &Runner{
+		Args:   os.Args,
+		Env:    env.Parse(os.Environ()),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run the Plugin as a good Munin citizen.
+// Supports the "dirty config" capability for one-shot configuration and value emission,
+// and the "multigraph" capability for plugins which implement MultigraphPlugin.
+//
+// If env.strict is set, configuration is validated before it is emitted
+// and the plugin exits with an error instead of emitting a Config Munin would reject.
+// The "lint" command prints every Problem found without emitting anything else.
+// The "json" command, or "--format=json", prints configuration and values together as JSONOutput.
+//
+// Config and Fetch must finish within env.timeout seconds, or DefaultTimeout if it is not set.
+// Plugins which implement ContextPlugin or ContextMultigraphPlugin are cancelled when time runs out.
+//
+// Every fetch also calls Config, or Graphs for a MultigraphPlugin, so that Series it leaves out
+// are reported as unknown. Both share the timeout, so keep Config cheap, e.g. by building it from
+// the environment or State rather than querying the system being monitored.
+func Run(p Plugin) {
+	os.Exit(RunWith(p))
+}
+
+// RunWith runs the Plugin like Run, with the arguments, environment and output streams
+// replaced by opts, and returns the exit code instead of exiting.
+func RunWith(p Plugin, opts ...Option) int {
+	return NewRunner(opts...).Run(p)
+}
+
+// Run the Plugin and return the exit code.
+func (r *Runner) Run(p Plugin) int {
+	var name, command string
+	if len(r.Args) > 0 {
+		name = r.Args[0]
+	}
+	if len(r.Args) == 2 {
+		command = r.Args[1]
+	}
+
+	switch command {
+	case "help", "--help", "-h":
+		fmt.Fprintf(r.Stdout, "%s\n", p.Help())
+		return 0
+	}
+
+	e := r.pluginEnv(p, name)
+	r.name = e.Plugin()
+
+	switch command {
+	case "autoconf":
+		r.emitAutoConf(p, e)
+		return 0
+	case "suggest":
+		return r.emitSuggestions(p, e)
+	}
+
+	ctx, cancel := r.runContext(e)
+	defer cancel()
+
+	if command == "lint" {
+		return r.emitLint(ctx, p, e)
+	}
+	if command == "json" || command == "--format=json" {
+		return r.emitJSON(ctx, p, e)
+	}
+
+	if mp, ok := asMultigraph(p, e); ok {
+		if command == "config" {
+			confs, ok := r.emitGraphConfigs(ctx, mp, e)
+			if !ok {
+				return 1
+			}
+			if e["MUNIN_CAP_DIRTYCONFIG"] == "1" {
+				return r.emitGraphValues(ctx, mp, e, confs)
+			}
+			return 0
+		}
+
+		confs, _ := loadGraphs(ctx, mp, e)
+		return r.emitGraphValues(ctx, mp, e, confs)
+	}
+
+	if command == "config" {
+		conf, ok := r.emitConfig(ctx, p, e)
+		if !ok {
+			return 1
+		}
+		if e["MUNIN_CAP_DIRTYCONFIG"] == "1" {
+			return r.emitValues(ctx, p, e, conf)
+		}
+		return 0
+	}
+
+	// Configuration is only used to report missing values as unknown,
+	// so values are still emitted if it cannot be loaded. See Run.
+	conf, _ := loadConfig(ctx, p, e)
+	return r.emitValues(ctx, p, e, conf)
+}
+
+// Fetch the plugin's samples as Run would, without the Series Run adds as unknown from the configuration.
+// Samples are keyed by graph name when the plugin is fetched as a multigraph, or by "" otherwise.
+// Samples are returned along with a PartialError, which Run emits as a warning.
+func (r *Runner) Fetch(p Plugin) (map[string]Samples, error) {
+	var name string
+	if len(r.Args) > 0 {
+		name = r.Args[0]
+	}
+	e := r.pluginEnv(p, name)
+
+	ctx, cancel := r.runContext(e)
+	defer cancel()
+
+	if mp, ok := asMultigraph(p, e); ok {
+		samples, _, err := fetchGraphSamples(ctx, mp, e)
+		return samples, err
+	}
+	samples, _, err := fetchSamples(ctx, p, e)
+	if samples == nil {
+		return nil, err
+	}
+	return map[string]Samples{"": samples}, err
+}
+
+// pluginEnv is the Env the plugin is run with: r.Env with the plugin and wildcard parsed from its name.
+func (r *Runner) pluginEnv(p Plugin, name string) Env {
+	e := make(Env, len(r.Env)+2)
+	for k, v := range r.Env {
+		e[k] = v
+	}
+	var prefix string
+	if w, ok := p.(WildcardPlugin); ok {
+		prefix = w.WildcardPrefix()
+	}
+	e[PluginEnv], e[WildcardEnv] = parsePluginName(name, prefix)
+	return e
+}
+
+// asMultigraph returns p as a MultigraphPlugin if it is one and munin-node supports multigraphs.
+func asMultigraph(p Plugin, e Env) (MultigraphPlugin, bool) {
+	mp, ok := p.(MultigraphPlugin)
+	return mp, ok && e["MUNIN_CAP_MULTIGRAPH"] == "1"
+}
+
+// errorf prints an error message to Stderr, prefixed with the plugin name for munin-node logs.
+func (r *Runner) errorf(format string, a ...interface{}) {
+	fmt.Fprintf(r.Stderr, "%s: %s\n", r.name, strings.TrimRight(fmt.Sprintf(format, a...), "\n"))
+}
+
+// warnf prints a warning message to Stderr, prefixed with the plugin name for munin-node logs.
+func (r *Runner) warnf(format string, a ...interface{}) {
+	r.errorf("warning: "+format, a...)
+}
+
+// fail with a message for err and return the exit code.
+// The message is clearer if the plugin ran out of time or was interrupted.
+func (r *Runner) fail(ctx context.Context, err error) int {
+	switch {
+	case ctx.Err() == nil:
+		r.errorf("%v", err)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		r.errorf("timed out, increase env.timeout if this happens often: %v", err)
+	default:
+		r.errorf("interrupted: %v", err)
+	}
+	return 1
+}
+
+// recoverFetch from err if it is a PartialError or TransientError, reporting it as a warning.
+// Returns whether to keep the fetched values, or an exit code if the run cannot recover.
+func (r *Runner) recoverFetch(ctx context.Context, err error) (keep bool, code int, ok bool) {
+	var partial *PartialError
+	var transient *TransientError
+	switch {
+	case ctx.Err() != nil:
+		return false, r.fail(ctx, err), false
+	case errors.As(err, &partial):
+		r.warnf("%v", err)
+		return true, 0, true
+	case errors.As(err, &transient):
+		r.warnf("%v", err)
+		return false, 0, true
+	default:
+		return false, r.fail(ctx, err), false
+	}
+}
+
+func (r *Runner) emitAutoConf(p Plugin, e Env) {
+	ac, ok := p.(AutoConfigurer)
+	if !ok {
+		fmt.Fprintln(r.Stdout, "no (autoconf not supported)")
+		return
+	}
+
+	if yes, reason := ac.AutoConf(e); yes {
+		fmt.Fprintln(r.Stdout, "yes")
+	} else if reason == "" {
+		fmt.Fprintln(r.Stdout, "no")
+	} else {
+		fmt.Fprintf(r.Stdout, "no (%s)\n", reason)
+	}
+}
+
+func (r *Runner) emitSuggestions(p Plugin, e Env) int {
+	s, ok := p.(Suggester)
+	if !ok {
+		return 0
+	}
+
+	suggestions, err := s.Suggest(e)
+	if err != nil {
+		return r.fail(context.Background(), err)
+	}
+
+	for _, suggestion := range suggestions {
+		fmt.Fprintln(r.Stdout, suggestion)
+	}
+	return 0
+}
+
+// emitLint prints Problems found in the configuration and returns the exit code.
+func (r *Runner) emitLint(ctx context.Context, p Plugin, e Env) int {
+	var err error
+	if mp, ok := p.(MultigraphPlugin); ok {
+		var confs map[string]Config
+		if confs, err = loadGraphs(ctx, mp, e); err == nil {
+			err = ValidateGraphs(confs)
+		}
+	} else {
+		var conf Config
+		if conf, err = loadConfig(ctx, p, e); err == nil {
+			err = conf.Validate()
+		}
+	}
+
+	var ps Problems
+	if err != nil && !errors.As(err, &ps) {
+		return r.fail(ctx, err)
+	}
+
+	for _, problem := range ps {
+		fmt.Fprintln(r.Stdout, problem)
+	}
+	if len(ps.Errors()) != 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkStrict validation of configuration if env.strict is set,
+// returning false if Munin would reject it.
+func (r *Runner) checkStrict(e Env, err error) bool {
+	if !isTrue(e["strict"]) || err == nil {
+		return true
+	}
+
+	var ps Problems
+	if !errors.As(err, &ps) {
+		r.errorf("%s", err)
+		return false
+	}
+	for _, problem := range ps {
+		r.errorf("%s", problem)
+	}
+	return len(ps.Errors()) == 0
+}
+
+func (r *Runner) emitConfig(ctx context.Context, p Plugin, e Env) (conf Config, ok bool) {
+	conf, err := loadConfig(ctx, p, e)
+	if err != nil {
+		r.fail(ctx, err)
+		return
+	}
+	if !r.checkStrict(e, conf.Validate()) {
+		return
+	}
+
+	fmt.Fprintf(r.Stdout, "%s", conf)
+	return conf, true
+}
+
+// emitValues fetched by the plugin, with any Series from conf which are missing reported as unknown.
+func (r *Runner) emitValues(ctx context.Context, p Plugin, e Env, conf Config) int {
+	samples, precision, err := fetchSamples(ctx, p, e)
+	if err != nil {
+		keep, code, ok := r.recoverFetch(ctx, err)
+		if !ok {
+			return code
+		}
+		if !keep {
+			samples = nil
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	writeSamples(buf, samples.withUnknowns(conf), precision)
+	fmt.Fprint(r.Stdout, buf.String())
+	return 0
+}
+
+func (r *Runner) emitGraphConfigs(ctx context.Context, p MultigraphPlugin, e Env) (confs map[string]Config, ok bool) {
+	confs, err := loadGraphs(ctx, p, e)
+	if err != nil {
+		r.fail(ctx, err)
+		return
+	}
+	if !r.checkStrict(e, ValidateGraphs(confs)) {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for _, name := range graphNames(confs) {
+		fmt.Fprintf(buf, "multigraph %s\n", CleanGraphName(name))
+		fmt.Fprintf(buf, "%s", confs[name])
+	}
+	fmt.Fprint(r.Stdout, buf.String())
+	return confs, true
+}
+
+// emitGraphValues fetched by the plugin, with any graphs or Series from confs which are missing reported as unknown.
+func (r *Runner) emitGraphValues(ctx context.Context, p MultigraphPlugin, e Env, confs map[string]Config) int {
+	samples, precision, err := fetchGraphSamples(ctx, p, e)
+	if err != nil {
+		keep, code, ok := r.recoverFetch(ctx, err)
+		if !ok {
+			return code
+		}
+		if !keep {
+			samples = nil
+		}
+	}
+
+	all := make(map[string]Config, len(confs)+len(samples))
+	for name := range samples {
+		all[name] = Config{}
+	}
+	for name, conf := range confs {
+		all[name] = conf
+	}
+
+	buf := new(bytes.Buffer)
+	for _, name := range graphNames(all) {
+		fmt.Fprintf(buf, "multigraph %s\n", CleanGraphName(name))
+		writeSamples(buf, samples[name].withUnknowns(all[name]), precision[name])
+	}
+	fmt.Fprint(r.Stdout, buf.String())
+	return 0
+}
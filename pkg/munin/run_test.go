@@ -0,0 +1,275 @@
+package munin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testPlugin struct {
+	delay time.Duration
+}
+
+func (p *testPlugin) Help() string {
+	return "Test plugin"
+}
+
+func (p *testPlugin) WildcardPrefix() string {
+	return "test_"
+}
+
+func (p *testPlugin) Config(env Env) (conf Config, err error) {
+	conf.Title = "Test " + env.Wildcard()
+	conf.Series = map[string]Series{
+		"a": NewSeries("a").WithType(Gauge),
+		"b": NewSeries("b").WithType(Gauge),
+	}
+	return
+}
+
+func (p *testPlugin) Fetch(env Env) (values Values, precision Precision, err error) {
+	time.Sleep(p.delay)
+	values = Values{"a": 1}
+	return
+}
+
+type testErrorPlugin struct {
+	testPlugin
+	err error
+}
+
+func (p *testErrorPlugin) Fetch(env Env) (values Values, precision Precision, err error) {
+	values = Values{"a": 1}
+	err = p.err
+	return
+}
+
+type testMultigraphPlugin struct {
+	testPlugin
+}
+
+func (p *testMultigraphPlugin) Graphs(env Env) (confs map[string]Config, err error) {
+	conf, err := p.Config(env)
+	confs = map[string]Config{"test": conf, "test.more": {Title: "More"}}
+	return
+}
+
+func (p *testMultigraphPlugin) FetchGraphs(env Env) (values map[string]Values, precision map[string]Precision, err error) {
+	values = map[string]Values{"test": {"a": 1, "b": 2}}
+	return
+}
+
+func (p *testMultigraphPlugin) AutoConf(env Env) (ok bool, reason string) {
+	return false, "just testing"
+}
+
+func TestRunWith(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugin   Plugin
+		args     []string
+		env      Env
+		wantCode int
+		want     string
+		wantErr  string
+	}{
+		{
+			"help",
+			new(testPlugin),
+			[]string{"test", "help"},
+			nil,
+			0,
+			"Test plugin\n",
+			"",
+		},
+		{
+			"config",
+			new(testPlugin),
+			[]string{"/etc/munin/plugins/test_foo", "config"},
+			nil,
+			0,
+			"graph_title Test foo\na.label a\na.type GAUGE\nb.label b\nb.type GAUGE\n",
+			"",
+		},
+		{
+			"dirty config",
+			new(testPlugin),
+			[]string{"test", "config"},
+			Env{"MUNIN_CAP_DIRTYCONFIG": "1"},
+			0,
+			"graph_title Test \na.label a\na.type GAUGE\nb.label b\nb.type GAUGE\na.value 1\nb.value U\n",
+			"",
+		},
+		{
+			"fetch",
+			new(testPlugin),
+			[]string{"test"},
+			nil,
+			0,
+			"a.value 1\nb.value U\n",
+			"",
+		},
+		{
+			"autoconf not supported",
+			new(testPlugin),
+			[]string{"test", "autoconf"},
+			nil,
+			0,
+			"no (autoconf not supported)\n",
+			"",
+		},
+		{
+			"autoconf",
+			new(testMultigraphPlugin),
+			[]string{"test", "autoconf"},
+			nil,
+			0,
+			"no (just testing)\n",
+			"",
+		},
+		{
+			"multigraph config",
+			new(testMultigraphPlugin),
+			[]string{"test", "config"},
+			Env{"MUNIN_CAP_MULTIGRAPH": "1"},
+			0,
+			"multigraph test\ngraph_title Test \na.label a\na.type GAUGE\nb.label b\nb.type GAUGE\nmultigraph test.more\ngraph_title More\n",
+			"",
+		},
+		{
+			"multigraph fetch",
+			new(testMultigraphPlugin),
+			[]string{"test"},
+			Env{"MUNIN_CAP_MULTIGRAPH": "1"},
+			0,
+			"multigraph test\na.value 1\nb.value 2\nmultigraph test.more\n",
+			"",
+		},
+		{
+			"multigraph fallback",
+			new(testMultigraphPlugin),
+			[]string{"test"},
+			nil,
+			0,
+			"a.value 1\nb.value U\n",
+			"",
+		},
+		{
+			"timeout",
+			&testPlugin{delay: time.Second},
+			[]string{"test"},
+			Env{"timeout": "0.01"},
+			1,
+			"",
+			"test: timed out, increase env.timeout if this happens often: context deadline exceeded\n",
+		},
+		{
+			"config error",
+			&testErrorPlugin{err: &ConfigError{errors.New("env.host is not set")}},
+			[]string{"test"},
+			nil,
+			1,
+			"",
+			"test: configuration: env.host is not set\n",
+		},
+		{
+			"transient error",
+			&testErrorPlugin{err: &TransientError{errors.New("no response")}},
+			[]string{"test"},
+			nil,
+			0,
+			"a.value U\nb.value U\n",
+			"test: warning: no response\n",
+		},
+		{
+			"partial error",
+			&testErrorPlugin{err: &PartialError{errors.New("b is missing")}},
+			[]string{"test"},
+			nil,
+			0,
+			"a.value 1\nb.value U\n",
+			"test: warning: b is missing\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+			code := RunWith(tt.plugin, WithArgs(tt.args...), WithEnv(tt.env), WithStdout(stdout), WithStderr(stderr))
+			if code != tt.wantCode {
+				t.Errorf("RunWith() = %d, want %d (stderr %q)", code, tt.wantCode, stderr)
+			}
+			if got := stdout.String(); got != tt.want {
+				t.Errorf("RunWith() stdout = %q, want %q", got, tt.want)
+			}
+			if got := stderr.String(); got != tt.wantErr {
+				t.Errorf("RunWith() stderr = %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunnerFetch(t *testing.T) {
+	partial := &PartialError{Err: errors.New("partial")}
+	tests := []struct {
+		name    string
+		plugin  Plugin
+		env     Env
+		want    map[string]Samples
+		wantErr error
+	}{
+		{"plugin", &testPlugin{}, nil, map[string]Samples{"": {"a": {{Value: 1}}}}, nil},
+		{"partial error", &testErrorPlugin{err: partial}, nil, map[string]Samples{"": {"a": {{Value: 1}}}}, partial},
+		{"multigraph without capability", &testMultigraphPlugin{}, nil, map[string]Samples{"": {"a": {{Value: 1}}}}, nil},
+		{
+			"multigraph",
+			&testMultigraphPlugin{},
+			Env{"MUNIN_CAP_MULTIGRAPH": "1"},
+			map[string]Samples{"test": {"a": {{Value: 1}}, "b": {{Value: 2}}}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewRunner(WithArgs("test"), WithEnv(tt.env)).Fetch(tt.plugin)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Fetch() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fetch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type testContextSamplePlugin struct {
+	testPlugin
+	cancelled chan error
+}
+
+func (p *testContextSamplePlugin) FetchSamplesContext(ctx context.Context, env Env) (samples Samples, precision Precision, err error) {
+	<-ctx.Done()
+	p.cancelled <- ctx.Err()
+	samples = Samples{"a": {{Value: 1}}}
+	return
+}
+
+func TestFetchSamplesContextCancelled(t *testing.T) {
+	p := &testContextSamplePlugin{cancelled: make(chan error, 1)}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := RunWith(p, WithArgs("test"), WithEnv(Env{"timeout": "0.01"}), WithStdout(stdout), WithStderr(stderr))
+	if code != 1 || stdout.Len() != 0 {
+		t.Errorf("RunWith() = %d, stdout %q, want 1 and no values", code, stdout)
+	}
+
+	select {
+	case err := <-p.cancelled:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("FetchSamplesContext() cancelled with %v, want deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("FetchSamplesContext() was not cancelled")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultStateDir is used for plugin state when MUNIN_PLUGSTATE is not set,
+// for example when running a plugin by hand or in tests.
+var DefaultStateDir = filepath.Join(os.TempDir(), "munin-plugstate")
+
+// ErrNoPluginName is returned by State when the Env has no plugin name,
+// since the state of one plugin could otherwise be mixed up with another's.
+var ErrNoPluginName = errors.New("plugin state needs a plugin name, set by Run from the name the plugin was invoked as")
+
+// State persisted between runs of a plugin.
+// Each key is stored as a JSON file in the MUNIN_PLUGSTATE directory provided by munin-node.
+// Files are replaced atomically and guarded by a lock file,
+// so concurrent invocations of the same plugin see either the old or new value.
+type State struct {
+	dir    string
+	plugin string
+}
+
+// State for the plugin, rooted at MUNIN_PLUGSTATE or DefaultStateDir.
+// Every method returns ErrNoPluginName if the Env has no plugin name.
+func (e Env) State() *State {
+	s := new(State)
+	s.dir = e["MUNIN_PLUGSTATE"]
+	if s.dir == "" {
+		s.dir = DefaultStateDir
+	}
+	s.plugin = e.Plugin()
+	return s
+}
+
+// Load the value stored under key into v, which should be a pointer.
+// Returns false if nothing has been stored yet.
+func (s *State) Load(key string, v interface{}) (found bool, err error) {
+	unlock, err := s.lock(key, false)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	return s.read(key, v)
+}
+
+// Save v under key, replacing any previous value.
+func (s *State) Save(key string, v interface{}) (err error) {
+	unlock, err := s.lock(key, true)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	return s.write(key, v)
+}
+
+// Update the value stored under key while holding an exclusive lock.
+// The previous value, if any, is loaded into v before calling fn.
+// v is saved afterwards unless fn returns an error.
+func (s *State) Update(key string, v interface{}, fn func(found bool) error) (err error) {
+	unlock, err := s.lock(key, true)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	found, err := s.read(key, v)
+	if err != nil {
+		return
+	}
+
+	if err = fn(found); err != nil {
+		return
+	}
+
+	return s.write(key, v)
+}
+
+func (s *State) path(key string) string {
+	return filepath.Join(s.dir, CleanFieldName(s.plugin)+"."+CleanFieldName(key)+".json")
+}
+
+func (s *State) read(key string, v interface{}) (found bool, err error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return
+	}
+
+	return true, nil
+}
+
+func (s *State) write(key string, v interface{}) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	path := s.path(key)
+	f, err := ioutil.TempFile(s.dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// lock key for reading (shared) or writing (exclusive) across processes.
+func (s *State) lock(key string, exclusive bool) (unlock func(), err error) {
+	if s.plugin == "" {
+		return nil, ErrNoPluginName
+	}
+	if err = os.MkdirAll(s.dir, 0755); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(s.path(key)+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+
+	if err = lockFile(f, exclusive); err != nil {
+		f.Close()
+		return
+	}
+
+	unlock = func() {
+		unlockFile(f)
+		f.Close()
+	}
+	return
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestStateUpdate(t *testing.T) {
+	e := Env{"MUNIN_PLUGSTATE": t.TempDir(), PluginEnv: "test"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int
+			err := e.State().Update("count", &n, func(found bool) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var n int
+	found, err := e.State().Load("count", &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || n != 20 {
+		t.Errorf("Load() = %v, %v, want true, 20", n, found)
+	}
+}
+
+func TestStateWithoutPluginName(t *testing.T) {
+	e := Env{"MUNIN_PLUGSTATE": t.TempDir()}
+
+	var n int
+	if _, err := e.State().Load("count", &n); !errors.Is(err, ErrNoPluginName) {
+		t.Errorf("Load() error = %v, want ErrNoPluginName", err)
+	}
+	if err := e.State().Save("count", n); !errors.Is(err, ErrNoPluginName) {
+		t.Errorf("Save() error = %v, want ErrNoPluginName", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package munin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxLabelLength of a Series label before it is likely to crowd the graph legend.
+const MaxLabelLength = 19
+
+// A Problem found when validating a Config.
+type Problem struct {
+	// Graph name, for multigraph plugins.
+	Graph string
+
+	// Field name of the series with the problem, or empty for graph-level problems.
+	Field string
+
+	// Message describing the problem.
+	Message string
+
+	// Warning is true if Munin will still accept the Config, though it may not look right.
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+
+	var where []string
+	if p.Graph != "" {
+		where = append(where, p.Graph)
+	}
+	if p.Field != "" {
+		where = append(where, p.Field)
+	}
+	if len(where) == 0 {
+		return level + ": " + p.Message
+	}
+
+	return level + ": " + strings.Join(where, ".") + ": " + p.Message
+}
+
+// Problems found when validating a Config.
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	lines := make([]string, len(ps))
+	for i, p := range ps {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Errors are the Problems which are not warnings.
+func (ps Problems) Errors() (errs Problems) {
+	for _, p := range ps {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	return
+}
+
+// InGraph sets the graph name of each Problem.
+func (ps Problems) InGraph(name string) Problems {
+	for i := range ps {
+		ps[i].Graph = name
+	}
+	return ps
+}
+
+// Validate each graph of a multigraph plugin, including collisions between graph names.
+// Returns Problems, including warnings, if there are any.
+func ValidateGraphs(confs map[string]Config) error {
+	var ps Problems
+
+	names := make(map[string][]string)
+	for _, name := range graphNames(confs) {
+		clean := CleanGraphName(name)
+		names[clean] = append(names[clean], name)
+		ps = append(ps, confs[name].problems().InGraph(name)...)
+	}
+
+	for _, name := range graphNames(confs) {
+		clean := CleanGraphName(name)
+		if keys := names[clean]; len(keys) > 1 && keys[0] == name {
+			ps = append(ps, Problem{Graph: clean, Message: fmt.Sprintf("graphs %s all have the same name", strings.Join(keys, ", "))})
+		}
+	}
+
+	if len(ps) != 0 {
+		return ps
+	}
+	return nil
+}
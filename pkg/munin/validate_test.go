@@ -0,0 +1,58 @@
+package munin
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestConfigProblems(t *testing.T) {
+	conf := Config{
+		Title: "Two\nlines",
+		Order: []string{"missing"},
+		Series: map[string]Series{
+			"a.b":       NewSeries("dotted"),
+			"a_b":       NewSeries("underscored"),
+			"graph_foo": NewSeries("reserved"),
+			"nolabel":   NewSeries(""),
+			"long":      NewSeries("a very long label indeed"),
+			"inverted":  NewSeries("inverted").WithWarnings(10, 5),
+			"narrow":    NewSeries("narrow").WithWarningRange(1, math.NaN()).WithCriticalRange(3, math.NaN()),
+		},
+	}
+
+	want := Problems{
+		{Message: "title contains a newline"},
+		{Message: `ordered series "missing" does not exist`},
+		{Field: "inverted", Message: "warning 10 is above critical 5"},
+		{Field: "long", Message: "label is 24 characters long, keep it under 19 to fit the graph legend", Warning: true},
+		{Field: "narrow", Message: "warning min 1 is below critical min 3"},
+		{Field: "nolabel", Message: "label is empty"},
+		{Field: "a_b", Message: "series a.b, a_b all have the same field name"},
+		{Field: "graph_foo", Message: "field name is reserved by Munin"},
+	}
+	err := conf.Validate()
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("Validate() = \n%v\nwant\n%v", err, want)
+	}
+
+	if ps, ok := err.(Problems); ok && len(ps.Errors()) != len(want)-1 {
+		t.Errorf("len(Errors()) = %d, want %d", len(ps.Errors()), len(want)-1)
+	}
+}
+
+func TestValidateGraphs(t *testing.T) {
+	confs := map[string]Config{
+		"a-b": {Title: "A"},
+		"a_b": {Title: "B"},
+		"c":   {},
+	}
+
+	want := Problems{
+		{Graph: "c", Message: "title is empty"},
+		{Graph: "a_b", Message: "graphs a-b, a_b all have the same name"},
+	}
+	if err := ValidateGraphs(confs); !reflect.DeepEqual(err, want) {
+		t.Errorf("ValidateGraphs() = %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package muninrun runs a plugin the way munin-node would and pretty-prints the result,
+// to debug plugins without a munin-node. cmd/munin-run is its command line interface.
+//
+// Plugins are either executables, Go package directories which are built first,
+// or in-process plugins registered with Register, which a Go plugin can use to debug
+// itself without being built and executed separately.
+package muninrun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/node"
+	"github.com/quells/munin/pkg/pluginconf"
+)
+
+// DefaultTimeout for a plugin run, the same as munin-node.
+const DefaultTimeout = 10 * time.Second
+
+// A Runner runs plugins with settings from plugin-conf.d files.
+type Runner struct {
+	// Conf with per-plugin settings from plugin-conf.d files. May be nil.
+	Conf *pluginconf.Conf
+
+	// PluginDir containing plugin executables, for plugins named without a path.
+	PluginDir string
+
+	// Name to run the plugin as, e.g. "pihole_pi.hole" for a wildcard plugin.
+	// Defaults to the base name of the plugin.
+	Name string
+
+	// Multigraph and DirtyConfig capabilities advertised to the plugin.
+	Multigraph  bool
+	DirtyConfig bool
+
+	// Raw prints plugin output as-is instead of pretty-printing it.
+	Raw bool
+
+	// Verbose prints the environment set for the plugin first.
+	Verbose bool
+
+	// Stdout receives the output. Defaults to os.Stdout.
+	Stdout io.Writer
+
+	// Stderr receives warnings and anything the plugin writes to stderr. Defaults to os.Stderr.
+	Stderr io.Writer
+
+	plugins map[string]munin.Plugin
+}
+
+// Register an in-process plugin under name.
+// In-process plugins take precedence over executables with the same name.
+func (r *Runner) Register(name string, p munin.Plugin) {
+	if r.plugins == nil {
+		r.plugins = make(map[string]munin.Plugin)
+	}
+	r.plugins[name] = p
+}
+
+// Run the plugin target with command, or config and fetch if command is empty.
+// Without a command, config and values are printed as a table of fields for each graph,
+// followed by any validation problems, which are an error if Munin would reject the config.
+func (r *Runner) Run(target, command string) error {
+	name := r.Name
+	if name == "" {
+		name = filepath.Base(target)
+	}
+	conf := r.Conf.Resolve(name)
+	e, set := r.pluginEnv(conf)
+
+	var p plugin
+	if ip, ok := r.plugins[target]; ok {
+		if conf.User != "" || conf.Group != "" {
+			fmt.Fprintf(r.stderr(), "warning: in-process plugins run as the current user, ignoring user %s and group %s\n", conf.User, conf.Group)
+		}
+		p = &inProcess{plugin: ip, name: name, env: e, stderr: r.stderr()}
+	} else {
+		path, cleanup, err := r.locate(target, name)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		p = &executable{path: path, name: name, conf: conf, env: e, stderr: r.stderr()}
+	}
+
+	if r.Verbose {
+		printEnv(r.stdout(), set)
+	}
+
+	if command != "" || r.Raw {
+		commands := []string{command}
+		if command == "" {
+			commands = []string{"config", "fetch"}
+		}
+		for _, c := range commands {
+			out, err := p.run(c)
+			r.stdout().Write(out)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	out, err := p.run("config")
+	if err != nil {
+		r.stdout().Write(out)
+		return err
+	}
+	confs, err := munin.ParseConfig(bytes.NewReader(out))
+	if err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	if out, err = p.run("fetch"); err != nil {
+		r.stdout().Write(out)
+		return err
+	}
+	values, precision, err := munin.ParseValues(bytes.NewReader(out))
+	if err != nil {
+		return fmt.Errorf("parsing values: %w", err)
+	}
+
+	// a plugin without multigraph output has a single graph named ""
+	if conf, ok := confs[""]; ok {
+		delete(confs, "")
+		confs[name] = conf
+	}
+	if v, ok := values[""]; ok {
+		delete(values, "")
+		values[name] = v
+		precision[name] = precision[""]
+		delete(precision, "")
+	}
+	printGraphs(r.stdout(), confs, values, precision)
+
+	var ps munin.Problems
+	if errors.As(munin.ValidateGraphs(confs), &ps) {
+		fmt.Fprintln(r.stdout())
+		for _, problem := range ps {
+			fmt.Fprintln(r.stdout(), problem)
+		}
+		if len(ps.Errors()) != 0 {
+			return errors.New("config has errors")
+		}
+	}
+	return nil
+}
+
+func (r *Runner) stdout() io.Writer {
+	if r.Stdout == nil {
+		return os.Stdout
+	}
+	return r.Stdout
+}
+
+func (r *Runner) stderr() io.Writer {
+	if r.Stderr == nil {
+		return os.Stderr
+	}
+	return r.Stderr
+}
+
+// locate the plugin executable for target, building it first if it is a Go package.
+func (r *Runner) locate(target, name string) (path string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	if !strings.ContainsRune(target, os.PathSeparator) && !strings.ContainsRune(target, '/') {
+		return filepath.Join(r.PluginDir, target), cleanup, nil
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return target, cleanup, nil
+	}
+
+	dir, err := ioutil.TempDir("", "munin-run")
+	if err != nil {
+		return
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	path = filepath.Join(dir, name)
+
+	build := exec.Command("go", "build", "-o", path, ".")
+	build.Dir = target
+	build.Stdout = r.stderr()
+	build.Stderr = r.stderr()
+	if err = build.Run(); err != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("building %s: %w", target, err)
+	}
+	return
+}
+
+// pluginEnv the plugin runs with, the same as munin-node would give it:
+// node.BaseEnv with the MUNIN_* variables and plugin-conf.d settings.
+// Also returns the variables set on top of node.BaseEnv.
+func (r *Runner) pluginEnv(conf pluginconf.Plugin) (e, set munin.Env) {
+	e, set = node.BaseEnv(), munin.Env{"MUNIN_PLUGSTATE": munin.DefaultStateDir}
+	if r.Multigraph {
+		set["MUNIN_CAP_MULTIGRAPH"] = "1"
+	}
+	if r.DirtyConfig {
+		set["MUNIN_CAP_DIRTYCONFIG"] = "1"
+	}
+	for k, v := range conf.Env {
+		set[k] = v
+	}
+	if _, ok := set["timeout"]; !ok {
+		set["timeout"] = strconv.FormatFloat(timeout(conf).Seconds(), 'f', -1, 64)
+	}
+
+	for k, v := range set {
+		e[k] = v
+	}
+	return
+}
+
+func timeout(conf pluginconf.Plugin) time.Duration {
+	if conf.Timeout != 0 {
+		return conf.Timeout
+	}
+	return DefaultTimeout
+}
+
+// A plugin which can be run with a command, returning its output.
+type plugin interface {
+	run(command string) ([]byte, error)
+}
+
+// An executable plugin, run as a separate process.
+type executable struct {
+	path   string
+	name   string
+	conf   pluginconf.Plugin
+	env    munin.Env
+	stderr io.Writer
+}
+
+// run the plugin with command, returning its output.
+// Anything the plugin writes to stderr is passed through.
+func (p *executable) run(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout(p.conf))
+	defer cancel()
+
+	var args []string
+	if command != "fetch" {
+		args = append(args, command)
+	}
+
+	stdout := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, p.path, args...)
+	// run as the configured name so wildcard plugins see their suffix
+	cmd.Args[0] = p.name
+	cmd.Stdout = stdout
+	cmd.Stderr = p.stderr
+	for k, v := range p.env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if err := runAs(cmd, p.conf.User, p.conf.Group, p.stderr); err != nil {
+		return nil, err
+	}
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return stdout.Bytes(), fmt.Errorf("%s %s timed out after %v", p.name, command, timeout(p.conf))
+	}
+	if err != nil {
+		return stdout.Bytes(), fmt.Errorf("%s %s: %w", p.name, command, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// An inProcess plugin, run with munin.RunWith, which applies env.timeout itself.
+type inProcess struct {
+	plugin munin.Plugin
+	name   string
+	env    munin.Env
+	stderr io.Writer
+}
+
+func (p *inProcess) run(command string) ([]byte, error) {
+	args := []string{p.name}
+	if command != "fetch" {
+		args = append(args, command)
+	}
+
+	stdout := new(bytes.Buffer)
+	code := munin.RunWith(p.plugin,
+		munin.WithArgs(args...),
+		munin.WithEnv(p.env),
+		munin.WithStdout(stdout),
+		munin.WithStderr(p.stderr),
+	)
+	if code != 0 {
+		return stdout.Bytes(), fmt.Errorf("%s %s: exit status %d", p.name, command, code)
+	}
+	return stdout.Bytes(), nil
+}
+
+func printEnv(w io.Writer, e munin.Env) {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "environment:")
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s=%s\n", k, e[k])
+	}
+	fmt.Fprintln(w)
+}
+
+// printGraphs as a table of fields for each graph, with their current values.
+func printGraphs(w io.Writer, confs map[string]munin.Config, values map[string]munin.Values, precision map[string]munin.Precision) {
+	names := make(map[string]struct{})
+	for name := range confs {
+		names[name] = struct{}{}
+	}
+	for name := range values {
+		names[name] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for i, name := range sorted {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		conf, configured := confs[name]
+		switch {
+		case !configured:
+			fmt.Fprintf(w, "%s (not configured)\n", name)
+		case conf.Category != "":
+			fmt.Fprintf(w, "%s: %s [%s]\n", name, conf.Title, conf.Category)
+		default:
+			fmt.Fprintf(w, "%s: %s\n", name, conf.Title)
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  FIELD\tLABEL\tTYPE\tVALUE")
+		for _, field := range fields(conf, values[name]) {
+			label, typ := "-", "-"
+			if s, ok := conf.Series[field]; ok && s.Type != munin.Default {
+				label, typ = s.Label, s.Type.String()
+			} else if ok {
+				label = s.Label
+			}
+			value := "-"
+			if v, ok := values[name][field]; ok {
+				value = munin.FormatValue(v, precision[name][field])
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", field, label, typ, value)
+		}
+		tw.Flush()
+	}
+}
+
+// fields of a graph, in graph order then sorted, including any values without a series.
+func fields(conf munin.Config, values munin.Values) []string {
+	seen := make(map[string]bool)
+	var ordered []string
+	for _, field := range conf.Order {
+		if !seen[field] {
+			seen[field] = true
+			ordered = append(ordered, field)
+		}
+	}
+
+	var rest []string
+	for field := range conf.Series {
+		if !seen[field] {
+			seen[field] = true
+			rest = append(rest, field)
+		}
+	}
+	for field := range values {
+		if !seen[field] {
+			seen[field] = true
+			rest = append(rest, field)
+		}
+	}
+	sort.Strings(rest)
+	return append(ordered, rest...)
+}
@@ -0,0 +1,217 @@
+package muninrun
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/node"
+	"github.com/quells/munin/pkg/pluginconf"
+)
+
+const script = `#!/bin/sh
+if [ "$1" = "config" ]; then
+	echo "graph_title Answer"
+	echo "graph_order b"
+	echo "a.label a"
+	echo "b.label b"
+	echo "b.type GAUGE"
+	exit 0
+fi
+echo "a.value ${answer:-0}"
+echo "b.value 1.50"
+echo "c.value U"
+`
+
+const conf = `
+[*]
+env.answer 1
+timeout 5
+
+[ans*]
+env.answer 42
+`
+
+type testPlugin struct{}
+
+func (p *testPlugin) Help() string {
+	return "Test plugin"
+}
+
+func (p *testPlugin) Config(env munin.Env) (conf munin.Config, err error) {
+	conf.Title = "Test"
+	conf.Series = map[string]munin.Series{"a": munin.NewSeries("a").WithType(munin.Gauge)}
+	return
+}
+
+func (p *testPlugin) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	values = munin.Values{"a": 1}
+	if env["MUNIN_CAP_MULTIGRAPH"] == "1" {
+		values["multigraph"] = 1
+	}
+	return
+}
+
+func newRunner(t *testing.T) (r *Runner, stdout, stderr *bytes.Buffer) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "answer"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := pluginconf.Parse(strings.NewReader(conf), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr = new(bytes.Buffer), new(bytes.Buffer)
+	r = &Runner{Conf: c, PluginDir: dir, Stdout: stdout, Stderr: stderr}
+	r.Register("test", new(testPlugin))
+	return
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		runner  func(r *Runner)
+		target  string
+		command string
+		want    string
+	}{
+		{
+			"script",
+			nil,
+			"answer",
+			"",
+			"answer: Answer\n" +
+				"  FIELD  LABEL  TYPE   VALUE\n" +
+				"  b      b      GAUGE  1.50\n" +
+				"  a      a      -      42\n" +
+				"  c      -      -      U\n",
+		},
+		{
+			"run as name",
+			func(r *Runner) { r.Name = "other" },
+			"answer",
+			"fetch",
+			"a.value 1\nb.value 1.50\nc.value U\n",
+		},
+		{
+			"raw",
+			func(r *Runner) { r.Raw = true },
+			"answer",
+			"",
+			"graph_title Answer\ngraph_order b\na.label a\nb.label b\nb.type GAUGE\n" +
+				"a.value 42\nb.value 1.50\nc.value U\n",
+		},
+		{
+			"in-process",
+			nil,
+			"test",
+			"",
+			"test: Test\n" +
+				"  FIELD  LABEL  TYPE   VALUE\n" +
+				"  a      a      GAUGE  1\n",
+		},
+		{
+			"in-process multigraph",
+			func(r *Runner) { r.Multigraph = true },
+			"test",
+			"fetch",
+			"a.value 1\nmultigraph.value 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, stdout, stderr := newRunner(t)
+			if tt.runner != nil {
+				tt.runner(r)
+			}
+			if err := r.Run(tt.target, tt.command); err != nil {
+				t.Fatalf("Run() error = %v (stderr %q)", err, stderr)
+			}
+			if got := stdout.String(); got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFails(t *testing.T) {
+	r, _, _ := newRunner(t)
+	if err := r.Run("missing", ""); err == nil {
+		t.Error("Run(missing) error = nil, want error")
+	}
+
+	r.Register("broken", &testErrorPlugin{})
+	if err := r.Run("broken", ""); err == nil || !strings.Contains(err.Error(), "config has errors") {
+		t.Errorf("Run(broken) error = %v, want config errors", err)
+	}
+}
+
+type testErrorPlugin struct {
+	testPlugin
+}
+
+func (p *testErrorPlugin) Config(env munin.Env) (conf munin.Config, err error) {
+	conf.Series = map[string]munin.Series{"a": munin.NewSeries("a")}
+	return
+}
+
+func TestPluginEnv(t *testing.T) {
+	r := &Runner{Multigraph: true}
+	c, err := pluginconf.Parse(strings.NewReader(conf), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, set := r.pluginEnv(c.Resolve("answer"))
+	want := munin.Env{"MUNIN_CAP_MULTIGRAPH": "1", "MUNIN_PLUGSTATE": munin.DefaultStateDir, "answer": "42", "timeout": "5"}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("pluginEnv() set = %v, want %v", set, want)
+	}
+	want["PATH"] = node.BaseEnv()["PATH"]
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("pluginEnv() = %v, want %v", e, want)
+	}
+
+	_, set = (&Runner{}).pluginEnv(pluginconf.Plugin{})
+	if set["timeout"] != "10" || set["MUNIN_CAP_MULTIGRAPH"] != "" {
+		t.Errorf("pluginEnv() set = %v, want the default timeout and no capabilities", set)
+	}
+}
+
+func TestFields(t *testing.T) {
+	conf := munin.Config{
+		Order:  []string{"c", "a", "c"},
+		Series: map[string]munin.Series{"a": {}, "b": {}, "c": {}},
+	}
+	values := munin.Values{"a": 1, "d": 2}
+
+	if got, want := fields(conf, values), []string{"c", "a", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fields() = %v, want %v", got, want)
+	}
+}
+
+func TestPrintGraphs(t *testing.T) {
+	confs := map[string]munin.Config{
+		"a": {Title: "A", Category: "test", Series: map[string]munin.Series{"x": munin.NewSeries("x").WithType(munin.Derive)}},
+	}
+	values := map[string]munin.Values{"a": {"x": 1.234}, "b": {"y": 2}}
+	precision := map[string]munin.Precision{"a": {"x": 1}}
+
+	w := new(bytes.Buffer)
+	printGraphs(w, confs, values, precision)
+	want := "a: A [test]\n" +
+		"  FIELD  LABEL  TYPE    VALUE\n" +
+		"  x      x      DERIVE  1.2\n" +
+		"\n" +
+		"b (not configured)\n" +
+		"  FIELD  LABEL  TYPE  VALUE\n" +
+		"  y      -      -     2\n"
+	if got := w.String(); got != want {
+		t.Errorf("printGraphs() = %q, want %q", got, want)
+	}
+}
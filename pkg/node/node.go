@@ -0,0 +1,536 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package node serves munin plugins over the munin-node TCP protocol,
+// so a munin master can poll them without the Perl munin-node installed.
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/pluginconf"
+)
+
+// Version reported by the version command.
+const Version = "1.0.0"
+
+// DefaultPort munin-node listens on.
+const DefaultPort = 4949
+
+// DefaultPath plugins run with if the server has no PATH set.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Capabilities supported by the Server.
+var Capabilities = []string{"multigraph", "dirtyconfig"}
+
+// A Server speaks the munin-node protocol, serving in-process plugins registered with Register
+// and external plugin executables from PluginDir.
+// It is safe to register plugins while serving.
+type Server struct {
+	// Hostname reported to the master. Defaults to the OS hostname.
+	Hostname string
+
+	// PluginDir containing external plugin executables, e.g. /etc/munin/plugins.
+	// External plugins are not served if this is empty.
+	PluginDir string
+
+	// Env variables passed to every plugin, in addition to the MUNIN_* variables set by the Server.
+	Env munin.Env
+
+	// Timeout for each plugin run. Defaults to 10 seconds, like munin-node.
+	Timeout time.Duration
+
+	// IdleTimeout closes a connection when the master sends nothing for this long,
+	// like timeout in munin-node.conf. Defaults to 20 seconds.
+	IdleTimeout time.Duration
+
+	// Conf with per-plugin settings from plugin-conf.d files, overriding Env and Timeout.
+	// Plugins always run as the user the Server runs as, so user and group are ignored.
+	Conf *pluginconf.Conf
+
+	// Allow lists the networks masters may connect from, like cidr_allow in munin-node.conf.
+	// Connections from any other address are closed without a greeting.
+	// Every address is allowed if Allow is empty.
+	Allow []*net.IPNet
+
+	// ErrorLog for plugin errors and refused connections. Defaults to the log package's standard logger.
+	ErrorLog *log.Logger
+
+	mu        sync.RWMutex
+	plugins   map[string]munin.Plugin
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// Register an in-process plugin under name.
+// In-process plugins take precedence over external plugins with the same name.
+func (s *Server) Register(name string, p munin.Plugin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.plugins == nil {
+		s.plugins = make(map[string]munin.Plugin)
+	}
+	s.plugins[name] = p
+}
+
+// ListenAndServe on the TCP address addr, e.g. ":4949".
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve connections accepted from l, each in its own goroutine, until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, true) {
+		l.Close()
+		return fmt.Errorf("server closed")
+	}
+	defer s.track(l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Close all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) track(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
+
+// timeout for a run of the named plugin.
+func (s *Server) timeout(name string) time.Duration {
+	if t := s.Conf.Resolve(name).Timeout; t > 0 {
+		return t
+	}
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 10 * time.Second
+}
+
+// idleTimeout of a connection waiting for the master.
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return 20 * time.Second
+}
+
+// allowed reports whether a master at ip may connect.
+func (s *Server) allowed(ip net.IP) bool {
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, n := range s.Allow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAllow parses a comma separated list of networks in CIDR notation, e.g. "192.168.1.0/24,::1/128",
+// for Server.Allow. A plain IP address allows just that address.
+func ParseAllow(text string) (allow []*net.IPNet, err error) {
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(part); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("allow: %w", err)
+		}
+		allow = append(allow, n)
+	}
+	return
+}
+
+func (s *Server) logf(format string, a ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, a...)
+	} else {
+		log.Printf(format, a...)
+	}
+}
+
+// session state for a single connection.
+type session struct {
+	caps   map[string]bool
+	master string
+}
+
+func (s *Server) handle(conn net.Conn) {
+	if !s.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if !s.allowed(ip) {
+		s.logf("refused connection from %s", conn.RemoteAddr())
+		return
+	}
+
+	sess := session{caps: make(map[string]bool)}
+	if ip != nil {
+		sess.master = ip.String()
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "# munin node at %s\n", s.hostname())
+	conn.SetWriteDeadline(time.Now().Add(s.idleTimeout()))
+	if err := w.Flush(); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		if !scanner.Scan() {
+			return
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		command, args := fields[0], fields[1:]
+		if command == "quit" || command == "." {
+			return
+		}
+
+		s.dispatch(w, &sess, command, args)
+		conn.SetWriteDeadline(time.Now().Add(s.idleTimeout()))
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) dispatch(w io.Writer, sess *session, command string, args []string) {
+	switch command {
+	case "cap":
+		for _, c := range args {
+			sess.caps[c] = true
+		}
+		fmt.Fprintf(w, "cap %s\n", strings.Join(Capabilities, " "))
+
+	case "list":
+		if len(args) > 0 && args[0] != s.hostname() {
+			fmt.Fprintln(w)
+			return
+		}
+		fmt.Fprintln(w, strings.Join(s.List(), " "))
+
+	case "nodes":
+		fmt.Fprintf(w, "%s\n.\n", s.hostname())
+
+	case "version":
+		fmt.Fprintf(w, "munins node on %s version: %s\n", s.hostname(), Version)
+
+	case "config", "fetch":
+		if len(args) == 0 {
+			fmt.Fprint(w, "# Unknown service\n.\n")
+			return
+		}
+
+		var cmdArgs []string
+		if command == "config" {
+			cmdArgs = []string{"config"}
+		}
+
+		out, ok := s.run(sess, args[0], cmdArgs...)
+		if !ok {
+			fmt.Fprint(w, "# Unknown service\n.\n")
+			return
+		}
+		w.Write(out)
+		fmt.Fprint(w, ".\n")
+
+	default:
+		fmt.Fprint(w, "# Unknown command. Try cap, list, nodes, config, fetch, version or quit\n")
+	}
+}
+
+// List the names of every plugin served, in-process and external, sorted.
+func (s *Server) List() []string {
+	names := make(map[string]struct{})
+
+	s.mu.RLock()
+	for name := range s.plugins {
+		names[name] = struct{}{}
+	}
+	s.mu.RUnlock()
+
+	for _, name := range s.external() {
+		names[name] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// external plugin names found in PluginDir.
+func (s *Server) external() (names []string) {
+	if s.PluginDir == "" {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(s.PluginDir)
+	if err != nil {
+		s.logf("reading plugin directory: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if isPlugin(filepath.Join(s.PluginDir, entry.Name())) {
+			names = append(names, entry.Name())
+		}
+	}
+	return
+}
+
+// isPlugin if path is an executable file, following symlinks.
+func isPlugin(path string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// BaseEnv every plugin run starts from, before Server.Env, plugin-conf.d settings and MUNIN_* variables.
+// Like munin-node, plugins only get PATH from the server's environment, so they behave the same
+// however the server was started.
+func BaseEnv() munin.Env {
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = DefaultPath
+	}
+	return munin.Env{"PATH": path}
+}
+
+// env for a run of the named plugin in sess.
+func (s *Server) env(sess *session, name string) munin.Env {
+	e := BaseEnv()
+	for k, v := range s.Env {
+		e[k] = v
+	}
+	for k, v := range s.Conf.Resolve(name).Env {
+		e[k] = v
+	}
+	if sess.caps["multigraph"] {
+		e["MUNIN_CAP_MULTIGRAPH"] = "1"
+	}
+	if sess.caps["dirtyconfig"] {
+		e["MUNIN_CAP_DIRTYCONFIG"] = "1"
+	}
+	if sess.master != "" {
+		e["MUNIN_MASTER_IP"] = sess.master
+	}
+	if _, ok := e["timeout"]; !ok {
+		e["timeout"] = strconv.FormatFloat(s.timeout(name).Seconds(), 'f', -1, 64)
+	}
+	return e
+}
+
+// run the named plugin with args, returning its output, or false if there is no such plugin.
+func (s *Server) run(sess *session, name string, args ...string) (out []byte, ok bool) {
+	s.mu.RLock()
+	p, inProcess := s.plugins[name]
+	s.mu.RUnlock()
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	var code int
+	if inProcess {
+		code = munin.RunWith(p,
+			munin.WithArgs(append([]string{name}, args...)...),
+			munin.WithEnv(s.env(sess, name)),
+			munin.WithStdout(stdout),
+			munin.WithStderr(stderr),
+		)
+	} else {
+		path := filepath.Join(s.PluginDir, name)
+		if s.PluginDir == "" || strings.ContainsRune(name, '/') || !isPlugin(path) {
+			return nil, false
+		}
+		code = s.exec(sess, name, path, args, stdout, stderr)
+	}
+
+	if stderr.Len() != 0 {
+		s.logf("%s", strings.TrimRight(stderr.String(), "\n"))
+	}
+	// the master expects "." on a line of its own after the output
+	if stdout.Len() != 0 && !bytes.HasSuffix(stdout.Bytes(), []byte("\n")) {
+		stdout.WriteByte('\n')
+	}
+	if code != 0 {
+		s.logf("%s exited with %d", name, code)
+		stdout.WriteString("# Bad exit\n")
+	}
+	return stdout.Bytes(), true
+}
+
+// exec an external plugin, returning its exit code.
+func (s *Server) exec(sess *session, name, path string, args []string, stdout, stderr io.Writer) int {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout(name))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	for k, v := range s.env(sess, name) {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		fmt.Fprintf(stderr, "%s: timed out\n", filepath.Base(path))
+		return 1
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", filepath.Base(path), err)
+		return 1
+	}
+	return 0
+}
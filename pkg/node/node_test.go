@@ -0,0 +1,233 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/pluginconf"
+)
+
+type testPlugin struct{}
+
+func (p *testPlugin) Help() string {
+	return "Test plugin"
+}
+
+func (p *testPlugin) Config(env munin.Env) (conf munin.Config, err error) {
+	conf.Title = "Test"
+	conf.Series = map[string]munin.Series{"a": munin.NewSeries("a")}
+	return
+}
+
+func (p *testPlugin) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	values = munin.Values{"a": 1}
+	return
+}
+
+const script = `#!/bin/sh
+if [ "$1" = "config" ]; then
+	echo "graph_title Script"
+	echo "b.label b"
+	exit 0
+fi
+echo "b.value ${MUNIN_CAP_DIRTYCONFIG:-0}"
+`
+
+// answerScript reports a value set in plugin-conf.d.
+const answerScript = `#!/bin/sh
+echo "answer.value ${answer:-0}"
+`
+
+// noEOLScript leaves out the trailing newline.
+const noEOLScript = `#!/bin/sh
+printf 'c.value 1'
+`
+
+const conf = `
+[*]
+env.answer 1
+
+[ans*]
+env.answer 42
+`
+
+func startServer(t *testing.T) *Server {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "script"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "answer"), []byte(answerScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "noeol"), []byte(noEOLScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := pluginconf.Parse(strings.NewReader(conf), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Hostname:  "test.local",
+		PluginDir: dir,
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+		Conf:      c,
+	}
+	s.Register("test", new(testPlugin))
+	return s
+}
+
+func serve(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// converse sends each command and returns what the server responded with, including the greeting.
+// It is safe to call from other goroutines, reporting errors with t.Error.
+func converse(t *testing.T, addr string, commands ...string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer conn.Close()
+
+	for _, c := range commands {
+		fmt.Fprintln(conn, c)
+	}
+	fmt.Fprintln(conn, "quit")
+
+	out, err := ioutil.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		t.Error(err)
+	}
+	return string(out)
+}
+
+func TestServer(t *testing.T) {
+	addr := serve(t, startServer(t))
+
+	tests := []struct {
+		name     string
+		commands []string
+		want     string
+	}{
+		{"greeting", nil, ""},
+		{"list", []string{"list"}, "answer noeol script test\n"},
+		{"list other node", []string{"list other.local"}, "\n"},
+		{"nodes", []string{"nodes"}, "test.local\n.\n"},
+		{"version", []string{"version"}, "munins node on test.local version: " + Version + "\n"},
+		{"cap", []string{"cap multigraph"}, "cap multigraph dirtyconfig\n"},
+		{"config", []string{"config test"}, "graph_title Test\na.label a\n.\n"},
+		{"fetch", []string{"fetch test"}, "a.value 1\n.\n"},
+		{"external config", []string{"config script"}, "graph_title Script\nb.label b\n.\n"},
+		{"external fetch", []string{"fetch script"}, "b.value 0\n.\n"},
+		{"dirty config", []string{"cap dirtyconfig", "fetch script"}, "cap multigraph dirtyconfig\nb.value 1\n.\n"},
+		{"no trailing newline", []string{"fetch noeol"}, "c.value 1\n.\n"},
+		{"plugin conf", []string{"fetch answer"}, "answer.value 42\n.\n"},
+		{"unknown service", []string{"fetch README"}, "# Unknown service\n.\n"},
+		{"unknown command", []string{"help"}, "# Unknown command. Try cap, list, nodes, config, fetch, version or quit\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := "# munin node at test.local\n" + tt.want
+			if got := converse(t, addr, tt.commands...); got != want {
+				t.Errorf("response = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServerConcurrent(t *testing.T) {
+	s := startServer(t)
+	addr := serve(t, s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Register(fmt.Sprintf("test%d", i), new(testPlugin))
+			got := converse(t, addr, "fetch test", fmt.Sprintf("fetch test%d", i))
+			if strings.Count(got, "a.value 1\n.\n") != 2 {
+				t.Errorf("response = %q", got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := startServer(t)
+	s.IdleTimeout = 10 * time.Millisecond
+	conn, err := net.Dial("tcp", serve(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("connection not closed after IdleTimeout: %v", err)
+	}
+	if want := "# munin node at test.local\n"; string(out) != want {
+		t.Errorf("response = %q, want %q", out, want)
+	}
+}
+
+func TestServerAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow string
+		want  string
+	}{
+		{"everyone", "", "# munin node at test.local\na.value 1\n.\n"},
+		{"loopback", "10.0.0.0/8, 127.0.0.1", "# munin node at test.local\na.value 1\n.\n"},
+		{"elsewhere", "10.0.0.0/8,::1/128", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, err := ParseAllow(tt.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := startServer(t)
+			s.Allow = allow
+			if got := converse(t, serve(t, s), "fetch test"); got != tt.want {
+				t.Errorf("response = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAllow(t *testing.T) {
+	if _, err := ParseAllow("10.0.0.0/33"); err == nil {
+		t.Error("ParseAllow(10.0.0.0/33) error = nil, want error")
+	}
+
+	allow, err := ParseAllow("::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allow) != 1 || allow[0].String() != "::1/128" {
+		t.Errorf("ParseAllow(::1) = %v, want [::1/128]", allow)
+	}
+}
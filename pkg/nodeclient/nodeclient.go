@@ -0,0 +1,284 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package nodeclient queries a munin-node over TCP.
+//
+// It only speaks the protocol: config and fetch responses are parsed by munin.ParseConfig
+// and munin.ParseValues, which also read plugin output from anywhere else.
+package nodeclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+// ErrUnknownService is returned when the node does not have the requested plugin.
+var ErrUnknownService = errors.New("unknown service")
+
+// ErrBadExit is returned alongside any output when a plugin exits with an error on the node.
+var ErrBadExit = errors.New("plugin exited with an error")
+
+// A Client is a connection to a munin-node.
+// It is safe for concurrent use, though commands are sent one at a time.
+type Client struct {
+	// Node name from the greeting.
+	Node string
+
+	// Timeout for each command. Zero means no timeout.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	caps map[string]bool
+}
+
+// Dial a munin-node at addr, e.g. "localhost:4949", and read its greeting.
+func Dial(addr string) (*Client, error) {
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial but gives up when ctx is done.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient on an open connection to a munin-node, reading its greeting.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		caps: make(map[string]bool),
+	}
+
+	greeting, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	const prefix = "# munin node at "
+	if !strings.HasPrefix(greeting, prefix) {
+		return nil, fmt.Errorf("unexpected greeting %q", greeting)
+	}
+	c.Node = strings.TrimPrefix(greeting, prefix)
+
+	return c, nil
+}
+
+// Close the connection, politely.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprint(c.conn, "quit\n")
+	return c.conn.Close()
+}
+
+// Cap negotiates capabilities, e.g. "multigraph" and "dirtyconfig",
+// returning those supported by both the client and the node.
+func (c *Client) Cap(caps ...string) (supported []string, err error) {
+	line, err := c.command("cap " + strings.Join(caps, " "))
+	if err != nil {
+		return
+	}
+
+	nodeCaps := make(map[string]bool)
+	for _, cap := range strings.Fields(strings.TrimPrefix(line, "cap")) {
+		nodeCaps[cap] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caps = make(map[string]bool)
+	for _, cap := range caps {
+		if nodeCaps[cap] {
+			c.caps[cap] = true
+			supported = append(supported, cap)
+		}
+	}
+	return
+}
+
+// HasCap if the capability was negotiated with Cap.
+func (c *Client) HasCap(cap string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps[cap]
+}
+
+// List plugins on the node.
+func (c *Client) List() (plugins []string, err error) {
+	line, err := c.command("list")
+	if err != nil {
+		return
+	}
+	return strings.Fields(line), nil
+}
+
+// Nodes served by the node, usually just itself.
+func (c *Client) Nodes() (nodes []string, err error) {
+	lines, err := c.multiline("nodes")
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			nodes = append(nodes, line)
+		}
+	}
+	return
+}
+
+// Version of munin-node.
+func (c *Client) Version() (string, error) {
+	return c.command("version")
+}
+
+// Config of a plugin, keyed by graph name.
+// Plugins which do not use multigraph have a single graph named after the plugin.
+func (c *Client) Config(plugin string) (confs map[string]munin.Config, err error) {
+	lines, err := c.service("config", plugin)
+	if err != nil && !errors.Is(err, ErrBadExit) {
+		return
+	}
+
+	confs, perr := munin.ParseConfig(strings.NewReader(lines))
+	if perr != nil {
+		return nil, perr
+	}
+	if conf, ok := confs[""]; ok {
+		delete(confs, "")
+		confs[plugin] = conf
+	}
+	return
+}
+
+// Fetch values from a plugin, keyed by graph name then field name.
+// Plugins which do not use multigraph have a single graph named after the plugin.
+// Unknown values are NaN.
+func (c *Client) Fetch(plugin string) (values map[string]munin.Values, err error) {
+	lines, err := c.service("fetch", plugin)
+	if err != nil && !errors.Is(err, ErrBadExit) {
+		return
+	}
+
+	values, _, perr := munin.ParseValues(strings.NewReader(lines))
+	if perr != nil {
+		return nil, perr
+	}
+	if v, ok := values[""]; ok {
+		delete(values, "")
+		values[plugin] = v
+	}
+	return
+}
+
+// service runs config or fetch for plugin, returning the output.
+func (c *Client) service(command, plugin string) (output string, err error) {
+	if strings.ContainsAny(plugin, " \r\n") {
+		return "", fmt.Errorf("invalid plugin name %q", plugin)
+	}
+
+	lines, err := c.multiline(command + " " + plugin)
+	if err != nil {
+		return
+	}
+
+	for _, line := range lines {
+		switch strings.TrimSpace(line) {
+		case "# Unknown service":
+			return "", fmt.Errorf("%s: %w", plugin, ErrUnknownService)
+		case "# Bad exit", "# Timed out":
+			err = fmt.Errorf("%s: %w", plugin, ErrBadExit)
+		}
+	}
+	return strings.Join(lines, "\n"), err
+}
+
+// command sends line and reads a single line response.
+func (c *Client) command(line string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.send(line); err != nil {
+		return "", err
+	}
+	return c.readLine()
+}
+
+// multiline sends line and reads a response terminated by a single dot.
+func (c *Client) multiline(line string) (lines []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.send(line); err != nil {
+		return
+	}
+
+	for {
+		var l string
+		if l, err = c.readLine(); err != nil {
+			return
+		}
+		if l == "." {
+			return
+		}
+		lines = append(lines, l)
+	}
+}
+
+func (c *Client) send(line string) error {
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	_, err := fmt.Fprintf(c.conn, "%s\n", line)
+	return err
+}
+
+func (c *Client) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,138 @@
+package nodeclient
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/quells/munin/pkg/munin"
+	"github.com/quells/munin/pkg/node"
+)
+
+type testPlugin struct{}
+
+func (p *testPlugin) Help() string {
+	return "Test plugin"
+}
+
+func (p *testPlugin) Config(env munin.Env) (conf munin.Config, err error) {
+	conf.Title = "Test"
+	conf.Category = "testing"
+	conf.Base = 1024
+	conf.Series = map[string]munin.Series{
+		"a": munin.NewSeries("a").
+			WithType(munin.Derive).
+			WithRange(0, math.NaN()).
+			WithWarningRange(1, 10).
+			WithDraw(munin.AreaStack),
+		"b": munin.NewSeries("b").WithWarnings(5, 10),
+	}
+	conf = conf.WithLimits(0, math.NaN()).WithOrder("b", "a")
+	return
+}
+
+func (p *testPlugin) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	values = munin.Values{"a": 1.5}
+	precision = munin.Precision{"a": 1}
+	return
+}
+
+func (p *testPlugin) Graphs(env munin.Env) (confs map[string]munin.Config, err error) {
+	conf, err := p.Config(env)
+	confs = map[string]munin.Config{"test": conf, "test.more": {Title: "More"}}
+	return
+}
+
+func (p *testPlugin) FetchGraphs(env munin.Env) (values map[string]munin.Values, precision map[string]munin.Precision, err error) {
+	values = map[string]munin.Values{"test": {"a": 1, "b": 2}}
+	return
+}
+
+func dial(t *testing.T) *Client {
+	s := &node.Server{Hostname: "fake.local", ErrorLog: log.New(ioutil.Discard, "", 0)}
+	s.Register("test", new(testPlugin))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	c := dial(t)
+
+	if c.Node != "fake.local" {
+		t.Errorf("Node = %q, want fake.local", c.Node)
+	}
+
+	plugins, err := c.List()
+	if err != nil || !reflect.DeepEqual(plugins, []string{"test"}) {
+		t.Errorf("List() = %v, %v", plugins, err)
+	}
+
+	nodes, err := c.Nodes()
+	if err != nil || !reflect.DeepEqual(nodes, []string{"fake.local"}) {
+		t.Errorf("Nodes() = %v, %v", nodes, err)
+	}
+
+	confs, err := c.Config("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := new(testPlugin).Config(nil)
+	if got := confs["test"]; got.String() != want.String() {
+		t.Errorf("Config() = %q, want %q", got, want)
+	}
+
+	values, err := c.Fetch("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := values["test"]["a"], values["test"]["b"]
+	if a != 1.5 || !math.IsNaN(b) {
+		t.Errorf("Fetch() = %v, want a=1.5 and b unknown", values)
+	}
+
+	if _, err := c.Fetch("missing"); !errors.Is(err, ErrUnknownService) {
+		t.Errorf("Fetch(missing) error = %v, want ErrUnknownService", err)
+	}
+}
+
+func TestClientMultigraph(t *testing.T) {
+	c := dial(t)
+
+	caps, err := c.Cap("multigraph", "spool")
+	if err != nil || !reflect.DeepEqual(caps, []string{"multigraph"}) {
+		t.Fatalf("Cap() = %v, %v", caps, err)
+	}
+
+	confs, err := c.Config("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confs) != 2 || confs["test.more"].Title != "More" {
+		t.Errorf("Config() = %v, want test and test.more graphs", confs)
+	}
+
+	values, err := c.Fetch("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]munin.Values{"test": {"a": 1, "b": 2}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Fetch() = %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package pluginconf reads munin-node plugin configuration from plugin-conf.d files,
+// and resolves the settings a plugin runs with.
+//
+// Each file is made of sections named after the plugins they apply to,
+// which may be glob patterns like [pihole_*] or [*]:
+//
+//	[pihole_*]
+//	user nobody
+//	timeout 30
+//	env.host http://pi.hole
+//	env.except reply_CNAME,reply_IP
+//
+// When several sections match a plugin, they are applied from least to most specific
+// so the most specific setting wins. Sections with glob patterns are less specific
+// than a section naming the plugin exactly, and shorter patterns are less specific
+// than longer ones. Otherwise later sections win, and files in a directory are read
+// in name order, so settings in 99-local override those in 00-defaults.
+package pluginconf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+// DefaultDir munin-node reads plugin configuration from.
+const DefaultDir = "/etc/munin/plugin-conf.d"
+
+// A Section of a plugin-conf.d file.
+type Section struct {
+	// Pattern of plugin names the section applies to, e.g. "pihole_*".
+	Pattern string
+
+	// Env variables set by env.* directives, without the "env." prefix.
+	Env munin.Env
+
+	// User and Group to run the plugin as, empty if not set.
+	User, Group string
+
+	// Timeout for each run of the plugin, zero if not set.
+	Timeout time.Duration
+
+	// File and Line the section starts on, for error messages.
+	File string
+	Line int
+}
+
+// Matches if the section applies to the named plugin.
+func (s Section) Matches(plugin string) bool {
+	ok, _ := path.Match(s.Pattern, plugin)
+	return ok
+}
+
+func (s Section) isGlob() bool {
+	return strings.ContainsAny(s.Pattern, `*?[\`)
+}
+
+// Conf is every section read from plugin-conf.d files, in the order they were read.
+type Conf struct {
+	Sections []Section
+}
+
+// Plugin settings resolved from every section which applies to a plugin.
+type Plugin struct {
+	Env         munin.Env
+	User, Group string
+
+	// Timeout is zero if no section sets it.
+	Timeout time.Duration
+}
+
+// Read configuration from a single file, or from every file in a directory in name order.
+// Files in a directory starting with a dot or ending with a tilde are skipped,
+// like editor backups and swap files.
+func Read(p string) (*Conf, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return ReadFile(p)
+	}
+
+	entries, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Conf)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+
+		f, err := ReadFile(filepath.Join(p, name))
+		if err != nil {
+			return nil, err
+		}
+		c.Sections = append(c.Sections, f.Sections...)
+	}
+	return c, nil
+}
+
+// ReadFile of plugin configuration.
+func ReadFile(file string) (*Conf, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f, file)
+}
+
+// Parse plugin configuration from r, using file in error messages.
+func Parse(r io.Reader, file string) (*Conf, error) {
+	c := new(Conf)
+	var current *Section
+
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated section name", file, n)
+			}
+			pattern := strings.TrimSpace(line[1 : len(line)-1])
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid section name %q", file, n, pattern)
+			}
+
+			c.Sections = append(c.Sections, Section{
+				Pattern: pattern,
+				Env:     make(munin.Env),
+				File:    file,
+				Line:    n,
+			})
+			current = &c.Sections[len(c.Sections)-1]
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: setting outside of a section", file, n)
+		}
+
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch {
+		case strings.HasPrefix(key, "env."):
+			name := strings.TrimPrefix(key, "env.")
+			if name == "" {
+				return nil, fmt.Errorf("%s:%d: env. without a variable name", file, n)
+			}
+			current.Env[name] = value
+		case key == "user":
+			current.User = value
+		case key == "group":
+			current.Group = value
+		case key == "timeout":
+			secs, err := strconv.ParseFloat(value, 64)
+			if err != nil || secs <= 0 {
+				return nil, fmt.Errorf("%s:%d: invalid timeout %q", file, n, value)
+			}
+			current.Timeout = time.Duration(secs * float64(time.Second))
+		default:
+			// other munin-node directives, like command and host_name, are not supported
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return c, nil
+}
+
+// Matching sections for the named plugin, from least to most specific.
+func (c *Conf) Matching(plugin string) []Section {
+	var matches []Section
+	for _, s := range c.Sections {
+		if s.Matches(plugin) {
+			matches = append(matches, s)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.isGlob() != b.isGlob() {
+			return a.isGlob()
+		}
+		return len(a.Pattern) < len(b.Pattern)
+	})
+	return matches
+}
+
+// Resolve the settings for the named plugin from every section which applies to it.
+func (c *Conf) Resolve(plugin string) Plugin {
+	p := Plugin{Env: make(munin.Env)}
+	if c == nil {
+		return p
+	}
+
+	for _, s := range c.Matching(plugin) {
+		for k, v := range s.Env {
+			p.Env[k] = v
+		}
+		if s.User != "" {
+			p.User = s.User
+		}
+		if s.Group != "" {
+			p.Group = s.Group
+		}
+		if s.Timeout != 0 {
+			p.Timeout = s.Timeout
+		}
+	}
+	return p
+}
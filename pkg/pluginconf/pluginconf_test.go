@@ -0,0 +1,139 @@
+package pluginconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+const testConf = `
+# defaults for every plugin
+[*]
+user nobody
+env.lang en
+
+[pihole_*]
+timeout 30
+env.host http://pi.hole
+env.except reply_CNAME,reply_IP
+
+[pihole_*.lan]
+env.host http://pihole.lan
+
+[pihole_office.lan]
+user pihole
+group pihole
+env.except
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(testConf), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Section{
+		{Pattern: "*", User: "nobody", Env: munin.Env{"lang": "en"}, File: "test", Line: 3},
+		{Pattern: "pihole_*", Timeout: 30 * time.Second, Env: munin.Env{"host": "http://pi.hole", "except": "reply_CNAME,reply_IP"}, File: "test", Line: 7},
+		{Pattern: "pihole_*.lan", Env: munin.Env{"host": "http://pihole.lan"}, File: "test", Line: 12},
+		{Pattern: "pihole_office.lan", User: "pihole", Group: "pihole", Env: munin.Env{"except": ""}, File: "test", Line: 15},
+	}
+	if !reflect.DeepEqual(c.Sections, want) {
+		t.Errorf("Parse() = %+v, want %+v", c.Sections, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want string
+	}{
+		{"outside section", "env.host x\n", "test:1: setting outside of a section"},
+		{"unterminated", "[pihole\n", "test:1: unterminated section name"},
+		{"bad pattern", "[pihole_[]\n", `test:1: invalid section name "pihole_["`},
+		{"bad timeout", "[*]\ntimeout soon\n", `test:2: invalid timeout "soon"`},
+		{"empty env", "[*]\nenv. x\n", "test:2: env. without a variable name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.conf), "test")
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Parse() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c, err := Parse(strings.NewReader(testConf), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		plugin string
+		want   Plugin
+	}{
+		{"cpu", Plugin{User: "nobody", Env: munin.Env{"lang": "en"}}},
+		{"pihole_pi.hole", Plugin{
+			User:    "nobody",
+			Timeout: 30 * time.Second,
+			Env:     munin.Env{"lang": "en", "host": "http://pi.hole", "except": "reply_CNAME,reply_IP"},
+		}},
+		{"pihole_den.lan", Plugin{
+			User:    "nobody",
+			Timeout: 30 * time.Second,
+			Env:     munin.Env{"lang": "en", "host": "http://pihole.lan", "except": "reply_CNAME,reply_IP"},
+		}},
+		{"pihole_office.lan", Plugin{
+			User:    "pihole",
+			Group:   "pihole",
+			Timeout: 30 * time.Second,
+			Env:     munin.Env{"lang": "en", "host": "http://pihole.lan", "except": ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.plugin, func(t *testing.T) {
+			if got := c.Resolve(tt.plugin); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pluginconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"00-defaults":  "[pihole]\nenv.host http://pi.hole\ntimeout 5\n",
+		"99-local":     "[pihole]\nenv.host http://192.168.1.2\n",
+		"99-local~":    "[pihole]\nenv.host http://backup\n",
+		".99-local.sw": "[pihole]\nenv.host http://swap\n",
+	}
+	for name, conf := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Plugin{Timeout: 5 * time.Second, Env: munin.Env{"host": "http://192.168.1.2"}}
+	if got := c.Resolve("pihole"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %+v, want %+v", got, want)
+	}
+}
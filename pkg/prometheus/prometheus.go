@@ -0,0 +1,253 @@
+// Copyright 2021 Kai Wells
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package prometheus serves the values of a munin.Plugin in the Prometheus text exposition format,
+// so the same plugin can be scraped by Prometheus and polled by Munin.
+//
+// Each field becomes a metric named after its graph and field key, e.g. pihole_ads_blocked_today.
+// The Series label and info become the HELP text, and the GraphType becomes the metric type:
+// COUNTER and DERIVE are counters, everything else is a gauge.
+// Unknown values are left out, so the metric is absent from that scrape.
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+// ContentType of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// A Handler serves the values of a Plugin each time it is scraped.
+// The Plugin is run in-process with munin.RunWith, as munin-node would run it,
+// so it behaves the same in both worlds.
+type Handler struct {
+	// Name the plugin is run as, e.g. "pihole" or "pihole_pi.hole" for a wildcard plugin.
+	// Also used as the graph name for plugins which do not produce multigraph output.
+	Name string
+
+	Plugin munin.Plugin
+
+	// Env variables passed to the plugin on each run.
+	Env munin.Env
+
+	// ErrorLog for plugin errors. Defaults to the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// NewHandler for the plugin run as name with env.
+func NewHandler(name string, p munin.Plugin, env munin.Env) *Handler {
+	return &Handler{Name: name, Plugin: p, Env: env}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out, err := h.run("config")
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	confs, err := munin.ParseConfig(bytes.NewReader(out))
+	if err != nil {
+		h.fail(w, fmt.Errorf("parsing config: %w", err))
+		return
+	}
+
+	if out, err = h.run("fetch"); err != nil {
+		h.fail(w, err)
+		return
+	}
+	samples, _, err := munin.ParseSamples(bytes.NewReader(out))
+	if err != nil {
+		h.fail(w, fmt.Errorf("parsing values: %w", err))
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err = Write(buf, h.Name, confs, samples); err != nil {
+		h.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(buf.Bytes())
+}
+
+// run the plugin with command, returning its output.
+func (h *Handler) run(command string) ([]byte, error) {
+	e := make(munin.Env, len(h.Env)+1)
+	for k, v := range h.Env {
+		e[k] = v
+	}
+	e["MUNIN_CAP_MULTIGRAPH"] = "1"
+
+	args := []string{h.Name}
+	if command != "fetch" {
+		args = append(args, command)
+	}
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := munin.RunWith(h.Plugin,
+		munin.WithArgs(args...),
+		munin.WithEnv(e),
+		munin.WithStdout(stdout),
+		munin.WithStderr(stderr),
+	)
+	if stderr.Len() != 0 {
+		h.logf("%s", strings.TrimRight(stderr.String(), "\n"))
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("%s %s exited with %d", h.Name, command, code)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (h *Handler) fail(w http.ResponseWriter, err error) {
+	h.logf("%v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (h *Handler) logf(format string, a ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, a...)
+	} else {
+		log.Printf(format, a...)
+	}
+}
+
+// Write metrics for every field in samples, described by confs, in the text exposition format.
+// Graphs are keyed by name as returned by munin.ParseConfig and munin.ParseSamples,
+// with the graph named "" renamed to name.
+// Fields whose metric names collide with an earlier metric are skipped.
+func Write(w io.Writer, name string, confs map[string]munin.Config, samples map[string]munin.Samples) error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool)
+
+	for _, graph := range graphNames(samples) {
+		conf := confs[graph]
+		prefix := graph
+		if prefix == "" {
+			prefix = name
+		}
+
+		for _, field := range fieldNames(samples[graph]) {
+			metric := MetricName(prefix, field)
+			if seen[metric] {
+				continue
+			}
+			seen[metric] = true
+
+			var known []munin.Sample
+			for _, s := range samples[graph][field] {
+				if !math.IsNaN(s.Value) && !math.IsInf(s.Value, 0) {
+					known = append(known, s)
+				}
+			}
+			if len(known) == 0 {
+				continue
+			}
+			// only the latest sample, since a scrape cannot have several values for one series
+			s := known[len(known)-1]
+
+			typ := "untyped"
+			if series, ok := conf.Series[field]; ok {
+				typ = metricType(series.Type)
+				if help := helpText(series); help != "" {
+					fmt.Fprintf(bw, "# HELP %s %s\n", metric, escapeHelp(help))
+				}
+			}
+			fmt.Fprintf(bw, "# TYPE %s %s\n", metric, typ)
+
+			fmt.Fprintf(bw, "%s %s", metric, strconv.FormatFloat(s.Value, 'g', -1, 64))
+			if !s.Time.IsZero() {
+				fmt.Fprintf(bw, " %d", s.Time.UnixNano()/1e6)
+			}
+			bw.WriteByte('\n')
+		}
+	}
+
+	return bw.Flush()
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^A-Za-z0-9_:]`)
+
+// MetricName for a field in a graph, joined with an underscore.
+// Characters not allowed in metric names, like the dots in nested graph names, become underscores.
+func MetricName(graph, field string) string {
+	name := invalidMetricChars.ReplaceAllString(graph+"_"+field, "_")
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func metricType(t munin.GraphType) string {
+	switch t {
+	case munin.Counter, munin.Derive:
+		return "counter"
+	default:
+		return "gauge"
+	}
+}
+
+// helpText from the label and info of a series.
+func helpText(s munin.Series) string {
+	switch {
+	case s.Info == "" || s.Info == s.Label:
+		return s.Label
+	case s.Label == "":
+		return s.Info
+	default:
+		return s.Label + ": " + s.Info
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(text string) string {
+	return helpEscaper.Replace(text)
+}
+
+func graphNames(samples map[string]munin.Samples) []string {
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fieldNames(samples munin.Samples) []string {
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
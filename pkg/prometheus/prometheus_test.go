@@ -0,0 +1,141 @@
+package prometheus
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quells/munin/pkg/munin"
+)
+
+type testPlugin struct{}
+
+func (p *testPlugin) Help() string {
+	return "Test plugin"
+}
+
+func (p *testPlugin) Config(env munin.Env) (conf munin.Config, err error) {
+	conf.Title = "Test"
+	conf.Series = map[string]munin.Series{
+		"queries": munin.NewSeries("Queries").WithType(munin.Derive).WithRange(0, math.NaN()),
+		"clients": munin.NewSeries("Clients").WithInfo(`Clients seen today\yesterday`),
+		"status":  munin.NewSeries("Status"),
+	}
+	return
+}
+
+func (p *testPlugin) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	values = munin.Values{"queries": 1234, "clients": 12.5}
+	values.SetUnknown("status")
+	precision = munin.Precision{"clients": 1}
+	return
+}
+
+type testMultigraphPlugin struct {
+	testPlugin
+}
+
+func (p *testMultigraphPlugin) Graphs(env munin.Env) (confs map[string]munin.Config, err error) {
+	conf, err := p.Config(env)
+	confs = map[string]munin.Config{"test": conf, "test.upstreams": {
+		Title:  "Upstreams",
+		Series: map[string]munin.Series{"a": munin.NewSeries("a").WithType(munin.Counter)},
+	}}
+	return
+}
+
+func (p *testMultigraphPlugin) FetchGraphs(env munin.Env) (values map[string]munin.Values, precision map[string]munin.Precision, err error) {
+	v, pr, err := p.Fetch(env)
+	values = map[string]munin.Values{"test": v, "test.upstreams": {"a": 5}}
+	precision = map[string]munin.Precision{"test": pr}
+	return
+}
+
+type failingPlugin struct {
+	testPlugin
+}
+
+func (p *failingPlugin) Fetch(env munin.Env) (values munin.Values, precision munin.Precision, err error) {
+	err = &munin.ConfigError{Err: errors.New("env.host is not set")}
+	return
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		plugin munin.Plugin
+		code   int
+		want   string
+	}{
+		{
+			"plugin",
+			new(testPlugin),
+			200,
+			`# HELP test_1_clients Clients: Clients seen today\\yesterday
+# TYPE test_1_clients gauge
+test_1_clients 12.5
+# HELP test_1_queries Queries
+# TYPE test_1_queries counter
+test_1_queries 1234
+`,
+		},
+		{
+			"multigraph",
+			new(testMultigraphPlugin),
+			200,
+			`# HELP test_clients Clients: Clients seen today\\yesterday
+# TYPE test_clients gauge
+test_clients 12.5
+# HELP test_queries Queries
+# TYPE test_queries counter
+test_queries 1234
+# HELP test_upstreams_a a
+# TYPE test_upstreams_a counter
+test_upstreams_a 5
+`,
+		},
+		{
+			"error",
+			new(failingPlugin),
+			500,
+			"test.1 fetch exited with 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler("test.1", tt.plugin, nil)
+			h.ErrorLog = log.New(ioutil.Discard, "", 0)
+			if _, ok := tt.plugin.(munin.MultigraphPlugin); ok {
+				h.Name = "test"
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			if w.Code != tt.code {
+				t.Errorf("code = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	tests := []struct {
+		graph, field string
+		want         string
+	}{
+		{"pihole", "ads_blocked_today", "pihole_ads_blocked_today"},
+		{"pihole_pi.hole", "status", "pihole_pi_hole_status"},
+		{"9gag", "x", "_9gag_x"},
+	}
+	for _, tt := range tests {
+		if got := MetricName(tt.graph, tt.field); got != tt.want {
+			t.Errorf("MetricName(%q, %q) = %q, want %q", tt.graph, tt.field, got, tt.want)
+		}
+	}
+}